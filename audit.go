@@ -0,0 +1,87 @@
+package randomsanity
+
+// Every notification is recorded, so when somebody asks whether they
+// were told about a failure we can check (and so can they, with
+// GET /v1/notifications/<id>). Records are in the default namespace,
+// like registrations; the submitted bytes are not recorded.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type NotificationRecord struct {
+	Time      int64
+	UserID    string
+	Tag       string `datastore:",noindex"`
+	Reason    string `datastore:",noindex"`
+	RequestID string `datastore:",noindex"`
+	Channel   string `datastore:",noindex"` // "email"
+	Status    string `datastore:",noindex"` // See deliveryStatus
+}
+
+// Most records returned by notificationsHandler
+const maxNotificationRecords = 100
+
+// Describes how a notification went: "sent", "rate_limited"
+// (the user already got their quota for the day) or "error: ..."
+func deliveryStatus(limited bool, err error) string {
+	switch {
+	case err != nil:
+		return "error: " + err.Error()
+	case limited:
+		return "rate_limited"
+	}
+	return "sent"
+}
+
+// ctx must be for the default namespace
+func recordNotification(ctx appengine.Context, f failure, channel string, status string) {
+	n := NotificationRecord{time.Now().Unix(), f.UserID, f.Tag, f.Reason, f.RequestID, channel, status}
+	k := datastore.NewIncompleteKey(ctx, "NotificationRecord", nil)
+	if _, err := datastore.Put(ctx, k, &n); err != nil {
+		log.Printf("Datastore error recording notification: %s", err.Error())
+	}
+}
+
+// GET /v1/notifications/<id> returns the most recent notifications
+// for user id as a JSON array, newest first.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
+		return
+	}
+	if len(parts) > 4 {
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("notifications", clientIP(r, trustedProxies)), 60, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	uID := parts[3]
+	dbKey, err := userID(ctx, uID)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if dbKey == nil {
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
+		return
+	}
+	records := []NotificationRecord{}
+	q := datastore.NewQuery("NotificationRecord").Filter("UserID =", uID).Order("-Time").Limit(maxNotificationRecords)
+	if _, err := q.GetAll(defaultNamespace(ctx), &records); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,24 @@
+package randomsanity
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeliveryStatus(t *testing.T) {
+	var tests = []struct {
+		limited bool
+		err     error
+		want    string
+	}{
+		{false, nil, "sent"},
+		{true, nil, "rate_limited"},
+		{false, errors.New("mail quota exceeded"), "error: mail quota exceeded"},
+		{true, errors.New("memcache down"), "error: memcache down"},
+	}
+	for _, test := range tests {
+		if got := deliveryStatus(test.limited, test.err); got != test.want {
+			t.Errorf("deliveryStatus(%v, %v) = %q, want %q", test.limited, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package randomsanity
+
+// Check a whole file of values at once, e.g. to audit a keystore
+// without writing a client: upload newline-separated hex and download
+// a report with a verdict for every line.
+
+import (
+	"appengine"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest file accepted, in bytes, and most values in one file. Each
+// value uses up one of the client's /v1/q submissions for the hour,
+// so files longer than Settings.RateLimit are always rate-limited.
+const (
+	maxBatchFileBytes = 128 * 1024
+	maxBatchLines     = 1000
+)
+
+// Result for a line that isn't a value that can be checked (bad hex,
+// too short, ...); Reason says why
+const resultInvalid = "invalid"
+
+// One line of the report
+type batchVerdict struct {
+	Line     int      `json:"line"`   // From 1; blank lines are skipped, but counted
+	Result   string   `json:"result"` // resultRandom, resultNotRandom, resultNotUnique or resultInvalid
+	Reason   string   `json:"reason,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	b        []byte   // The line's bytes, nil if it's invalid
+}
+
+// True if r is a batch of values as JSON, which /v1/q passes on to
+// batchHandler
+func isJSONBatch(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == "POST" && mediaType == "application/json"
+}
+
+// Returns a batchVerdict for each non-blank line of the file uploaded
+// (as field "file") in r, or each non-blank string of a JSON array
+// body; only the invalid ones have a Result yet.
+func readBatch(w http.ResponseWriter, r *http.Request) ([]batchVerdict, *inputError) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var values []string
+	var e *inputError
+	switch mediaType {
+	case "multipart/form-data":
+		values, e = readBatchFile(w, r)
+	case "application/json":
+		values, e = readBatchJSON(w, r)
+	default:
+		return nil, &inputError{http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Content-Type must be multipart/form-data or application/json"}
+	}
+	if e != nil {
+		return nil, e
+	}
+	var lines []batchVerdict
+	for i, text := range values {
+		line := i + 1
+		s := strings.TrimSpace(text)
+		if len(s) == 0 {
+			continue
+		}
+		if len(lines) == maxBatchLines {
+			return nil, &inputError{http.StatusRequestEntityTooLarge, "too_large",
+				fmt.Sprintf("Must provide %d or fewer values", maxBatchLines)}
+		}
+		v := batchVerdict{Line: line}
+		b, err := hex.DecodeString(s)
+		switch {
+		case err != nil:
+			v.Result, v.Reason = resultInvalid, "Invalid hex"
+		case len(b) < minSubmissionBytes:
+			v.Result, v.Reason = resultInvalid, fmt.Sprintf("Must provide %d or more bytes", minSubmissionBytes)
+		case len(b) > maxInputBytes:
+			v.Result, v.Reason = resultInvalid, fmt.Sprintf("Must provide %d or fewer bytes", maxInputBytes)
+		default:
+			v.b = b
+		}
+		lines = append(lines, v)
+	}
+	if len(lines) == 0 {
+		return nil, &inputError{http.StatusBadRequest, "invalid_request", "No values to check"}
+	}
+	return lines, nil
+}
+
+// Returns the lines of the file uploaded as field "file"
+func readBatchFile(w http.ResponseWriter, r *http.Request) ([]string, *inputError) {
+	if r.ContentLength > 2*maxBatchFileBytes {
+		return nil, &inputError{http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("File must be %d or fewer bytes", maxBatchFileBytes)}
+	}
+	// Backstop for clients that don't send Content-Length
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxBatchFileBytes)
+	f, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return nil, &inputError{http.StatusBadRequest, "invalid_request", "No file uploaded"}
+	}
+	if err != nil {
+		return nil, &inputError{http.StatusBadRequest, "invalid_request", "Error reading request"}
+	}
+	defer f.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(f, maxBatchFileBytes+1))
+	if err != nil {
+		return nil, &inputError{http.StatusBadRequest, "invalid_request", "Error reading request"}
+	}
+	if len(body) > maxBatchFileBytes {
+		return nil, &inputError{http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("File must be %d or fewer bytes", maxBatchFileBytes)}
+	}
+	return strings.Split(string(body), "\n"), nil
+}
+
+// Returns the strings of a JSON array body, e.g. ["e47d...", "9191..."]
+func readBatchJSON(w http.ResponseWriter, r *http.Request) ([]string, *inputError) {
+	if r.ContentLength > maxBatchFileBytes {
+		return nil, &inputError{http.StatusRequestEntityTooLarge, "too_large",
+			fmt.Sprintf("Body must be %d or fewer bytes", maxBatchFileBytes)}
+	}
+	var values []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchFileBytes)).Decode(&values); err != nil {
+		return nil, &inputError{http.StatusBadRequest, "invalid_json", "Body must be a JSON array of hex strings"}
+	}
+	return values, nil
+}
+
+// Returns the number of lines that will be checked
+func batchCost(lines []batchVerdict) int {
+	n := 0
+	for _, v := range lines {
+		if v.b != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Fills in the verdict for each valid line: the statistical tests,
+// then (if they pass, and the line is long enough; see minUniqueBytes)
+// uniq, which says whether the bytes are unique, like looksUnique does
+// for /v1/q.
+func checkBatch(lines []batchVerdict, uniq func([]byte) (bool, error)) error {
+	for i := range lines {
+		if err := checkLine(&lines[i], uniq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fills in the verdict for one line (see checkBatch)
+func checkLine(v *batchVerdict, uniq func([]byte) (bool, error)) error {
+	if v.b == nil {
+		return nil
+	}
+	v.Warnings = Warnings(v.b)
+	if ok, reason := LooksRandom(v.b); !ok {
+		v.Result, v.Reason = resultNotRandom, reason
+		return nil
+	}
+	if len(v.b) < minUniqueBytes {
+		v.Result = resultRandom // The statistical tests were all that applied
+		return nil
+	}
+	b := v.b
+	if len(b) > 64 {
+		b = b[0:64] // Same limit on datastore lookups as /v1/q
+	}
+	unique, err := uniq(b)
+	if err != nil {
+		return err
+	}
+	if unique {
+		v.Result = resultRandom
+	} else {
+		v.Result, v.Reason = resultNotUnique, "Non Unique"
+	}
+	return nil
+}
+
+// Sends the report as an attachment, as JSON (an array of
+// batchVerdicts) or as CSV with the same columns
+func sendBatchReport(w http.ResponseWriter, lines []batchVerdict, format string) {
+	w.Header().Set("Cache-Control", resultCacheControl)
+	w.Header().Set("Content-Disposition", `attachment; filename="randomsanity-report.`+format+`"`)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		c := csv.NewWriter(w)
+		c.Write([]string{"line", "result", "reason", "warnings"})
+		for _, v := range lines {
+			c.Write([]string{strconv.Itoa(v.Line), v.Result, v.Reason, strings.Join(v.Warnings, "; ")})
+		}
+		c.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lines)
+}
+
+// The last event of a complete ?format=sse report
+type batchDone struct {
+	Lines int `json:"lines"` // Verdicts sent
+}
+
+// Writes a Server-Sent Event with v as JSON, and sends it to the
+// client straight away if w can do that
+func sendEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Checks lines one at a time, sending each verdict as a "verdict"
+// event as soon as it is known, then a "done" event. Stops early, with
+// no "done", if done is closed (the client went away) or with an
+// "error" event if uniq fails. App Engine's first-generation runtime
+// buffers responses, so there the events all arrive together at the
+// end.
+func streamBatch(w http.ResponseWriter, lines []batchVerdict, uniq func([]byte) (bool, error), done <-chan struct{}) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", resultCacheControl)
+	for i := range lines {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if err := checkLine(&lines[i], uniq); err != nil {
+			sendEvent(w, "error", errorResponse{"Datastore error", "datastore_error"})
+			return err
+		}
+		sendEvent(w, "verdict", lines[i])
+	}
+	sendEvent(w, "done", batchDone{len(lines)})
+	return nil
+}
+
+// POST multipart/form-data with the values, one hex value per line,
+// as field "file", or application/json with a JSON array of hex
+// values (which /v1/q also takes; see isJSONBatch). Add ?format=csv
+// for a CSV report instead of JSON, or ?format=sse for the verdicts
+// as Server-Sent Events while the values are checked (see
+// streamBatch).
+// Every value is checked like an anonymous /v1/q submission and uses
+// up one of the client's submissions for the hour.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "batch method must be POST")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "sse" {
+		sendError(w, r, http.StatusBadRequest, "invalid_format", "format must be json, csv or sse")
+		return
+	}
+	lines, e := readBatch(w, r)
+	if e != nil {
+		recordRejection(r, e.code)
+		sendError(w, r, e.status, e.code, e.msg)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	settings := getSettings(ctx)
+	cost := uint64(batchCost(lines))
+	if cost == 0 {
+		cost = 1 // Still a request
+	}
+	limited, err := RateLimitCostResponse(ctx, w, r, IPKey("q", clientIP(r, trustedProxies)), cost, uint64(settings.RateLimit), time.Hour)
+	if err != nil || limited {
+		return
+	}
+	nsCtx, err := namespaceContext(ctx, r)
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_namespace", "Invalid namespace")
+		return
+	}
+
+	// Like looksUnique, but without notifications, and no one
+	// value's failure to get a slot fails the batch
+	uniq := func(b []byte) (bool, error) {
+		switch {
+		case uniquenessMode == uniqueDisabled:
+			w.Header().Set("X-Uniqueness", "disabled")
+			return true, nil
+		case !datastoreBreaker.allow(time.Now()):
+			w.Header().Set("X-Uniqueness", "unavailable")
+			return true, nil
+		case !uniqueCheckSlots.acquire(uniqueCheckWait):
+			w.Header().Set("X-Uniqueness", "busy")
+			return true, nil
+		}
+		defer uniqueCheckSlots.release()
+		if uniquenessMode == uniqueReadOnly {
+			w.Header().Set("X-Uniqueness", "read-only")
+		}
+		match, err := unique(nsCtx, b, "", "", settings)
+		datastoreBreaker.record(err, time.Now())
+		return match == nil, err
+	}
+	if format == "sse" {
+		// X-Uniqueness is only sent if it was set before the
+		// first event
+		if streamBatch(w, lines, uniq, r.Context().Done()) == nil {
+			RecordUsage(nsCtx, "Batch", 1)
+			RecordUsage(nsCtx, "BatchValues", int64(cost))
+		}
+		return
+	}
+	if err := checkBatch(lines, uniq); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	RecordUsage(nsCtx, "Batch", 1)
+	RecordUsage(nsCtx, "BatchValues", int64(cost))
+	sendBatchReport(w, lines, format)
+}
@@ -0,0 +1,230 @@
+package randomsanity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A POST of file as a multipart/form-data upload, like a browser sends
+func uploadRequest(file string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "keys.txt")
+	part.Write([]byte(file))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/v1/batch", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// A POST of body as a JSON batch
+func jsonRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestBatch(t *testing.T) {
+	good := "e47d253e45ccfa65f44493677aaf56ae"
+	file := strings.Join([]string{
+		good,
+		"20202020202020202020202020202020",
+		"",
+		"not hex",
+		"e47d253e45ccfa65", // Too short for the uniqueness check
+		"919108f752d133205bacf847db4148a8\r",
+		good, // Repeated key
+		"e47d253e45ccfa",
+	}, "\n")
+	w := httptest.NewRecorder()
+	lines, e := readBatch(w, uploadRequest(file))
+	if e != nil {
+		t.Fatalf("readBatch: %s", e.msg)
+	}
+	if got := batchCost(lines); got != 5 {
+		t.Errorf("batchCost = %d, want 5", got)
+	}
+	seen := map[string]bool{}
+	err := checkBatch(lines, func(b []byte) (bool, error) {
+		if len(b) < minUniqueBytes {
+			t.Errorf("uniqueness checked for %x", b)
+		}
+		h := hex.EncodeToString(b)
+		unique := !seen[h]
+		seen[h] = true
+		return unique, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []batchVerdict{
+		{Line: 1, Result: resultRandom},
+		{Line: 2, Result: resultNotRandom, Reason: "Constant fill"},
+		{Line: 4, Result: resultInvalid, Reason: "Invalid hex"},
+		{Line: 5, Result: resultRandom},
+		{Line: 6, Result: resultRandom},
+		{Line: 7, Result: resultNotUnique, Reason: "Non Unique"},
+		{Line: 8, Result: resultInvalid, Reason: "Must provide 8 or more bytes"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, v := range lines {
+		if v.Line != want[i].Line || v.Result != want[i].Result || v.Reason != want[i].Reason {
+			t.Errorf("line %d = %+v, want %+v", i, v, want[i])
+		}
+	}
+
+	sendBatchReport(w, lines, "json")
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="randomsanity-report.json"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	var report []batchVerdict
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || len(report) != len(want) {
+		t.Fatalf("JSON report = %v (%v)", report, err)
+	}
+	if report[1].Result != resultNotRandom || report[1].Reason != "Constant fill" {
+		t.Errorf("JSON report line 2 = %+v", report[1])
+	}
+
+	w = httptest.NewRecorder()
+	sendBatchReport(w, lines, "csv")
+	csvLines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(csvLines) != len(want)+1 || csvLines[0] != "line,result,reason,warnings" ||
+		csvLines[3] != "4,invalid,Invalid hex," || csvLines[6] != "7,not_unique,Non Unique," {
+		t.Errorf("CSV report = %q", w.Body.String())
+	}
+}
+
+// JSON batches are read like files, one value per string; /v1/q
+// takes them too
+func TestReadBatchJSON(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/q", strings.NewReader(`["e47d253e45ccfa65f44493677aaf56ae", "", "not hex"]`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if !isJSONBatch(r) {
+		t.Errorf("isJSONBatch(%s) = false", r.Header.Get("Content-Type"))
+	}
+	lines, e := readBatch(httptest.NewRecorder(), r)
+	if e != nil {
+		t.Fatalf("readBatch: %s", e.msg)
+	}
+	if len(lines) != 2 || lines[0].b == nil || lines[1].Line != 3 || lines[1].Reason != "Invalid hex" {
+		t.Errorf("readBatch = %+v", lines)
+	}
+	for _, contentType := range []string{"text/plain", "application/octet-stream"} {
+		r := httptest.NewRequest("POST", "/v1/q", nil)
+		r.Header.Set("Content-Type", contentType)
+		if isJSONBatch(r) {
+			t.Errorf("isJSONBatch(%s) = true", contentType)
+		}
+	}
+}
+
+func TestReadBatchErrors(t *testing.T) {
+	var tests = []struct {
+		r    *http.Request
+		code string
+	}{
+		{httptest.NewRequest("POST", "/v1/batch", strings.NewReader("e47d253e45ccfa65f44493677aaf56ae")), "unsupported_media_type"},
+		{uploadRequest(""), "invalid_request"},
+		{uploadRequest(strings.Repeat("0", maxBatchFileBytes+1)), "too_large"},
+		{uploadRequest(strings.Repeat("e47d253e45ccfa65f44493677aaf56ae\n", maxBatchLines+1)), "too_large"},
+		{jsonRequest(`{"values": []}`), "invalid_json"},
+		{jsonRequest(`[]`), "invalid_request"},
+		{jsonRequest(`[` + strings.Repeat(`"e47d253e45ccfa65f44493677aaf56ae",`, maxBatchLines) + `"00"]`), "too_large"},
+	}
+	for i, test := range tests {
+		if _, e := readBatch(httptest.NewRecorder(), test.r); e == nil || e.code != test.code {
+			t.Errorf("readBatch(test %d) = %v, want %s", i, e, test.code)
+		}
+	}
+}
+
+// The events in an SSE body: event names and their data
+func parseEvents(body string) (names []string, data []string) {
+	for _, e := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		var name, d string
+		for _, l := range strings.Split(e, "\n") {
+			if strings.HasPrefix(l, "event: ") {
+				name = l[len("event: "):]
+			}
+			if strings.HasPrefix(l, "data: ") {
+				d = l[len("data: "):]
+			}
+		}
+		names, data = append(names, name), append(data, d)
+	}
+	return names, data
+}
+
+func TestStreamBatch(t *testing.T) {
+	file := strings.Join([]string{
+		"e47d253e45ccfa65f44493677aaf56ae",
+		"not hex",
+		"919108f752d133205bacf847db4148a8",
+		"20202020202020202020202020202020",
+		"5c0a8cbd2fb6e91347f0e2b8a46d1f39",
+	}, "\n")
+	w := httptest.NewRecorder()
+	lines, _ := readBatch(w, uploadRequest(file))
+	// Every earlier verdict has been sent (and flushed) by the time
+	// the next value is checked
+	checked := 0
+	err := streamBatch(w, lines, func(b []byte) (bool, error) {
+		names, _ := parseEvents(w.Body.String())
+		if checked > 0 && (!w.Flushed || len(names) < checked) {
+			t.Errorf("checking value %d, only %d events sent", checked+1, len(names))
+		}
+		checked++
+		return true, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	names, data := parseEvents(w.Body.String())
+	if len(names) != len(lines)+1 || names[len(names)-1] != "done" || data[len(data)-1] != `{"lines":5}` {
+		t.Fatalf("events = %q %q", names, data)
+	}
+	for i, d := range data[:len(lines)] {
+		var v batchVerdict
+		if err := json.Unmarshal([]byte(d), &v); err != nil || names[i] != "verdict" || v.Line != i+1 {
+			t.Errorf("event %d = %s %s, want verdict for line %d", i, names[i], d, i+1)
+		}
+	}
+
+	// The client goes away after the second value is checked
+	w = httptest.NewRecorder()
+	lines, _ = readBatch(w, uploadRequest(file))
+	done := make(chan struct{})
+	checked = 0
+	streamBatch(w, lines, func(b []byte) (bool, error) {
+		if checked++; checked == 2 {
+			close(done)
+		}
+		return true, nil
+	}, done)
+	if names, _ := parseEvents(w.Body.String()); len(names) != 3 || names[2] != "verdict" {
+		t.Errorf("events after disconnect = %q", names)
+	}
+
+	// Datastore errors end the stream
+	w = httptest.NewRecorder()
+	lines, _ = readBatch(w, uploadRequest(file))
+	err = streamBatch(w, lines, func(b []byte) (bool, error) {
+		return false, errors.New("datastore timeout")
+	}, nil)
+	if names, data := parseEvents(w.Body.String()); err == nil || len(names) != 1 || names[0] != "error" ||
+		!strings.Contains(data[0], "datastore_error") {
+		t.Errorf("events after error = %q %q (%v)", names, data, err)
+	}
+}
@@ -0,0 +1,55 @@
+package randomsanity
+
+// When the datastore is having problems every uniqueness check
+// waits for it to time out, and requests pile up. After
+// breakerThreshold failures in a row uniqueness checks are skipped
+// (the statistical tests still run) until breakerCooldown has passed;
+// then one request is let through to see if the datastore has
+// recovered.
+//
+// State is per-instance, so each instance notices on its own.
+
+import (
+	"sync"
+	"time"
+)
+
+const breakerThreshold = 5
+const breakerCooldown = 30 * time.Second
+
+type breaker struct {
+	sync.Mutex
+	failures  int       // In a row
+	openUntil time.Time // Only meaningful if failures >= breakerThreshold
+}
+
+// Returns true if the protected call should be made
+func (b *breaker) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	// Let this call probe; everybody else waits another cooldown
+	b.openUntil = now.Add(breakerCooldown)
+	return true
+}
+
+// Records the result of a call that allow let through
+func (b *breaker) record(err error, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+var datastoreBreaker breaker
@@ -0,0 +1,59 @@
+package randomsanity
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	var b breaker
+	now := time.Unix(1000000, 0)
+	failure := errors.New("datastore timeout")
+
+	// Closed: failures below the threshold don't stop anything
+	for i := 0; i < breakerThreshold-1; i++ {
+		if !b.allow(now) {
+			t.Fatalf("breaker open after %d failures", i)
+		}
+		b.record(failure, now)
+	}
+	// A success resets the count
+	b.record(nil, now)
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.record(failure, now)
+	}
+	if !b.allow(now) {
+		t.Error("breaker open after a success")
+	}
+
+	// Opens at the threshold
+	b.record(failure, now)
+	if b.allow(now) || b.allow(now.Add(breakerCooldown-time.Second)) {
+		t.Error("breaker not open after threshold failures")
+	}
+
+	// Half-open after the cooldown: one probe, then shut again
+	now = now.Add(breakerCooldown)
+	if !b.allow(now) {
+		t.Error("breaker didn't allow a probe after cooldown")
+	}
+	if b.allow(now) {
+		t.Error("breaker allowed two probes")
+	}
+	// Probe fails: open for another cooldown
+	b.record(failure, now)
+	if b.allow(now.Add(breakerCooldown - time.Second)) {
+		t.Error("breaker closed after a failed probe")
+	}
+
+	// Probe succeeds: closed
+	now = now.Add(breakerCooldown)
+	if !b.allow(now) {
+		t.Error("breaker didn't allow a second probe")
+	}
+	b.record(nil, now)
+	if !b.allow(now) || !b.allow(now) {
+		t.Error("breaker not closed after a successful probe")
+	}
+}
@@ -0,0 +1,45 @@
+package randomsanity
+
+// The false-positive budget every test is held to (see fpBits), so
+// operators can answer false-positive complaints with a stricter one
+// (or get tests running on shorter inputs with a looser one) without
+// shipping code. It's stored with the other settings.
+
+import (
+	"appengine"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type Budget struct {
+	FalsePositiveBits int64    // Each test fails random bytes 1-in-2^FalsePositiveBits times
+	TestList          TestList // The tests' minimum lengths at that budget
+}
+
+func currentBudget() Budget {
+	return Budget{int64(fpBits()), testList()}
+}
+
+// GET returns the Budget as JSON; POST bits=N changes it. Only admins
+// can call this (see app.yaml).
+func budgetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	s := getSettings(ctx)
+	if r.Method == "POST" {
+		r.ParseForm()
+		var err error
+		s, err = s.update(url.Values{"false_positive_bits": {r.Form.Get("bits")}})
+		if err != nil || len(r.Form.Get("bits")) == 0 {
+			sendError(w, r, http.StatusBadRequest, "invalid_budget", fmt.Sprintf("bits must be an integer from %d to %d", minFalsePositiveBits, maxFalsePositiveBits))
+			return
+		}
+		if err := saveSettings(ctx, s); err != nil {
+			sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+			return
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBudget())
+}
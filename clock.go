@@ -0,0 +1,97 @@
+package randomsanity
+
+// Machines that seed from the clock (time(NULL) and the like) often
+// leak the seed into their output as an embedded Unix timestamp. One
+// such submission proves nothing (random words look like a time from
+// the last day about 1 in 25,000 times), but many different sources
+// whose submissions embed the same instant probably all seeded from
+// one clock tick, say after a synchronized boot. Timestamps are
+// counted per clockTick-second tick, like fleet-wide collisions (see
+// fleet.go), and the fleetThreshold'th source to embed one gets a
+// summary.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	clockSeedAge = 24 * time.Hour // Older timestamps aren't looked for
+	clockTick    = 2              // Seconds; timestamps this close are one instant
+)
+
+// Returns the distinct ticks (Unix time / clockTick) of the 4-byte
+// big- or little-endian Unix timestamps in b from the clockSeedAge
+// before now, at 4-byte aligned offsets
+func embeddedTicks(b []byte, now int64) []int64 {
+	earliest := now - int64(clockSeedAge/time.Second)
+	seen := map[int64]bool{}
+	var ticks []int64
+	for i := 0; i+4 <= len(b); i += 4 {
+		for _, t := range []uint32{binary.BigEndian.Uint32(b[i:]), binary.LittleEndian.Uint32(b[i:])} {
+			tick := int64(t) / clockTick
+			if int64(t) < earliest || int64(t) > now || seen[tick] {
+				continue
+			}
+			seen[tick] = true
+			ticks = append(ticks, tick)
+		}
+	}
+	return ticks
+}
+
+// Counts source as having embedded tick (see FleetSources.add);
+// returns true if it's the one that makes it a fleet-wide cluster
+func countClockTick(ctx appengine.Context, tick int64, source string) (bool, error) {
+	key := datastore.NewKey(ctx, "ClockSources", strconv.FormatInt(tick, 10), 0, nil)
+	var escalate bool
+	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		var c FleetSources
+		if err := datastore.Get(ctx, key, &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		var each bool
+		each, escalate = c.add(source, time.Now().Unix())
+		if !each && !escalate {
+			return nil
+		}
+		_, err := datastore.Put(ctx, key, &c)
+		return err
+	}, nil)
+	return escalate, err
+}
+
+// Counts b's embedded timestamps toward clock-tick clusters, and
+// notifies the submitter of any it completes. Errors are ignored;
+// this never changes the verdict.
+func clockClusters(ctx appengine.Context, r *http.Request, b []byte, uID string, tag string) {
+	ticks := embeddedTicks(b, time.Now().Unix())
+	if len(ticks) == 0 {
+		return
+	}
+	secret, err := secretKey(ctx)
+	if err != nil {
+		return
+	}
+	source := fleetSource(secret, uID, tag, clientIP(r, trustedProxies))
+	for _, tick := range ticks {
+		if escalate, err := countClockTick(ctx, tick, source); err == nil && escalate {
+			RecordUsage(ctx, "ClockCluster", 1)
+			notify(ctx, clockFailure(uID, tag, tick))
+		}
+	}
+}
+
+// The notification for a clock-tick cluster; like a fleet-wide
+// collision's, it isn't about one request
+func clockFailure(uID string, tag string, tick int64) failure {
+	t := make([]byte, 4)
+	binary.BigEndian.PutUint32(t, uint32(tick*clockTick))
+	reason := "Clock-derived seed: timestamp " + time.Unix(tick*clockTick, 0).UTC().Format(time.RFC3339) +
+		" embedded by many sources"
+	return failure{UserID: uID, Tag: tag, Bytes: t, Reason: reason, Sources: fleetThreshold}
+}
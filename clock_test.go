@@ -0,0 +1,71 @@
+package randomsanity
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedTicks(t *testing.T) {
+	now := int64(1500000000)
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b[0:], uint32(now-60))
+	binary.LittleEndian.PutUint32(b[4:], uint32(now-60)) // Same tick
+	binary.LittleEndian.PutUint32(b[8:], uint32(now-3600))
+	binary.BigEndian.PutUint32(b[12:], uint32(now-2*86400)) // Too old
+	got := embeddedTicks(b, now)
+	if len(got) != 2 || got[0] != (now-60)/clockTick || got[1] != (now-3600)/clockTick {
+		t.Errorf("embeddedTicks = %v", got)
+	}
+	binary.BigEndian.PutUint32(b[0:], uint32(now+60)) // In the future
+	if got := embeddedTicks(b[:4], now); len(got) != 0 {
+		t.Errorf("embeddedTicks(future) = %v", got)
+	}
+}
+
+// Submissions from machines seeded within the same tick, counted like
+// countClockTick does (without the datastore)
+func TestClockClusters(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	now := int64(1500000000)
+	boot := now - 600 // Even, so boot and boot+1 are one tick
+	clusters := map[int64]*FleetSources{}
+	alerts := []int64{}
+	submit := func(b []byte, source string) {
+		for _, tick := range embeddedTicks(b, now) {
+			if clusters[tick] == nil {
+				clusters[tick] = &FleetSources{}
+			}
+			if _, escalate := clusters[tick].add(source, now); escalate {
+				alerts = append(alerts, tick)
+			}
+		}
+	}
+	for i := 0; i < 3*fleetThreshold; i++ {
+		b := make([]byte, 32)
+		rand.Read(b)
+		binary.BigEndian.PutUint32(b[8:], uint32(boot+int64(i%2)))
+		submit(b, fleetSource(secret, "", "", "192.0.2."+strconv.Itoa(i)))
+	}
+	if len(alerts) != 1 || alerts[0] != boot/clockTick {
+		t.Errorf("alerts for ticks %v, want [%d]", alerts, boot/clockTick)
+	}
+
+	// The same machine over and over isn't a fleet
+	alerts, clusters = nil, map[int64]*FleetSources{}
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b, uint32(boot))
+	for i := 0; i < 3*fleetThreshold; i++ {
+		submit(b, fleetSource(secret, "alice", "prod", "192.0.2.1"))
+	}
+	if len(alerts) != 0 {
+		t.Errorf("one source alerted for ticks %v", alerts)
+	}
+
+	body := failureEmailBody("", clockFailure("alice", "prod", boot/clockTick))
+	if !strings.Contains(body, "2017-07-14T02:30:00Z") || !strings.Contains(body, "different sources") {
+		t.Errorf("failureEmailBody = %q", body)
+	}
+}
@@ -0,0 +1,199 @@
+package randomsanity
+
+// Notifications for a registration can go to more addresses than the
+// one it was registered with: an on-call address and a team's shared
+// inbox, say. Each added contact is emailed a code, and only gets
+// notifications once the user confirms the address with it, so nobody
+// can have the service mail an address that didn't ask for it.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+)
+
+// A notification address besides NotifyViaEmail.Address
+type Contact struct {
+	Address  string
+	Code     string // Emailed to Address; cleared once it's verified
+	Verified bool
+}
+
+// Most contacts a registration can have
+const maxContacts = 8
+
+// Adds address as an unverified contact, to be verified with code
+func (n *NotifyViaEmail) addContact(address string, code string) error {
+	if strings.EqualFold(address, n.Address) {
+		return errors.New("That is the registered address")
+	}
+	for i, c := range n.Contacts {
+		if strings.EqualFold(address, c.Address) {
+			if c.Verified {
+				return errors.New("Already a contact")
+			}
+			n.Contacts[i].Code = code // A new code for another try
+			return nil
+		}
+	}
+	if len(n.Contacts) >= maxContacts {
+		return fmt.Errorf("At most %d contacts", maxContacts)
+	}
+	n.Contacts = append(n.Contacts, Contact{Address: address, Code: code})
+	return nil
+}
+
+// Marks address verified if code is the one it was sent; returns false
+// if it isn't (or address isn't a contact)
+func (n *NotifyViaEmail) verifyContact(address string, code string) bool {
+	for i, c := range n.Contacts {
+		if strings.EqualFold(address, c.Address) && !c.Verified && len(c.Code) > 0 &&
+			subtle.ConstantTimeCompare([]byte(code), []byte(c.Code)) == 1 {
+			n.Contacts[i] = Contact{Address: c.Address, Verified: true}
+			return true
+		}
+	}
+	return false
+}
+
+// Removes contact address; returns false if it wasn't one
+func (n *NotifyViaEmail) removeContact(address string) bool {
+	for i, c := range n.Contacts {
+		if strings.EqualFold(address, c.Address) {
+			n.Contacts = append(n.Contacts[:i], n.Contacts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// The addresses n's notifications go to: the registered one, and the
+// verified contacts
+func (n NotifyViaEmail) recipients() []string {
+	result := []string{n.Address}
+	for _, c := range n.Contacts {
+		if c.Verified {
+			result = append(result, c.Address)
+		}
+	}
+	return result
+}
+
+func sendContactCode(ctx appengine.Context, address string, code string) {
+	msg := &mail.Message{
+		Sender:  "randomsanityalerts@gmail.com",
+		To:      []string{address},
+		Subject: "Random Sanity contact verification",
+	}
+	msg.Body = fmt.Sprintf("Somebody asked for failure notifications from the randomsanity.org\n"+
+		"service to be sent to this email address (%s) as well.\n"+
+		"\n"+
+		"verification code: %s\n"+
+		"\n"+
+		"Give the code to whoever asked, so they can confirm the address.\n"+
+		"If you don't want these notifications, please ignore this message.\n",
+		address, code)
+	if err := mail.Send(ctx, msg); err != nil {
+		log.Printf("mail.Send failed: %s", err)
+	}
+}
+
+// POST /v1/contact/<id>?address=<email> adds a contact to user <id>'s
+// registration and emails it a code; POST ...&code=<code> verifies it.
+// DELETE /v1/contact/<id>?address=<email> removes it.
+func contactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "contact method must be POST or DELETE")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
+		return
+	}
+	if len(parts) > 4 {
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
+		return
+	}
+	addresses, err := netmail.ParseAddressList(r.FormValue("address"))
+	if err != nil || len(addresses) != 1 {
+		sendError(w, r, http.StatusBadRequest, "invalid_email", "Invalid email address")
+		return
+	}
+	address := addresses[0].Address
+	code := r.FormValue("code")
+
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("contact", clientIP(r, trustedProxies)), 10, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	dbKey, err := userID(ctx, parts[3])
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if dbKey == nil {
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
+		return
+	}
+
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
+	var n NotifyViaEmail
+	if err := datastore.Get(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	var message, sendCode string
+	switch {
+	case r.Method == "DELETE":
+		if !n.removeContact(address) {
+			sendError(w, r, http.StatusNotFound, "not_found", "Not a contact")
+			return
+		}
+		message = fmt.Sprintf("%s removed\n", address)
+	case len(code) > 0:
+		if !n.verifyContact(address, code) {
+			sendError(w, r, http.StatusBadRequest, "invalid_code", "Wrong verification code")
+			return
+		}
+		message = fmt.Sprintf("%s verified; it will get notifications\n", address)
+	default:
+		// Codes are mailed at most once a day per address
+		limited, err := RateLimitResponse(ctx, w, r, "contact"+address, 1, time.Hour*24)
+		if err != nil || limited {
+			return
+		}
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			sendError(w, r, http.StatusInternalServerError, "internal_error", "rand.Read error")
+			return
+		}
+		code = hex.EncodeToString(b)
+		if err := n.addContact(address, code); err != nil {
+			sendError(w, r, http.StatusBadRequest, "invalid_contact", err.Error())
+			return
+		}
+		sendCode = code
+		message = fmt.Sprintf("Verification code sent to %s\n", address)
+	}
+	if _, err := datastore.Put(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if len(sendCode) > 0 {
+		sendContactCode(ctx, address, sendCode)
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	fmt.Fprint(w, message)
+}
@@ -0,0 +1,58 @@
+package randomsanity
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestContacts(t *testing.T) {
+	n := NotifyViaEmail{UserID: "0123456789abcdef", Address: "alice@example.com"}
+	if err := n.addContact("oncall@example.com", "code1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.addContact("team@example.com", "code2"); err != nil {
+		t.Fatal(err)
+	}
+	// Unverified contacts aren't sent anything
+	if got := n.recipients(); !reflect.DeepEqual(got, []string{"alice@example.com"}) {
+		t.Errorf("recipients() = %q", got)
+	}
+	if n.verifyContact("oncall@example.com", "code2") || n.verifyContact("nobody@example.com", "code1") {
+		t.Error("verifyContact accepted the wrong code")
+	}
+	if !n.verifyContact("oncall@example.com", "code1") {
+		t.Error("verifyContact(oncall) = false")
+	}
+	if got := n.recipients(); !reflect.DeepEqual(got, []string{"alice@example.com", "oncall@example.com"}) {
+		t.Errorf("recipients() = %q", got)
+	}
+	// A code only works once
+	if n.verifyContact("oncall@example.com", "code1") || n.Contacts[0].Code != "" {
+		t.Errorf("verified twice: %+v", n.Contacts)
+	}
+	if !n.verifyContact("Team@example.com", "code2") {
+		t.Error("verifyContact(team) = false")
+	}
+	if got := n.recipients(); !reflect.DeepEqual(got, []string{"alice@example.com", "oncall@example.com", "team@example.com"}) {
+		t.Errorf("recipients() = %q", got)
+	}
+
+	if n.addContact("alice@example.com", "x") == nil || n.addContact("oncall@example.com", "x") == nil {
+		t.Error("addContact added the registered address, or a verified contact again")
+	}
+	if !n.removeContact("oncall@example.com") || n.removeContact("oncall@example.com") {
+		t.Error("removeContact(oncall) didn't remove it once")
+	}
+	if got := n.recipients(); !reflect.DeepEqual(got, []string{"alice@example.com", "team@example.com"}) {
+		t.Errorf("recipients() = %q", got)
+	}
+	for i := len(n.Contacts); i < maxContacts; i++ {
+		if err := n.addContact("c"+strconv.Itoa(i)+"@example.com", "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n.addContact("onemore@example.com", "x") == nil {
+		t.Errorf("added more than %d contacts", maxContacts)
+	}
+}
@@ -0,0 +1,131 @@
+package randomsanity
+
+// Cross-sample tests: are several samples from the same RNG
+// suspiciously similar to each other? This catches generators that
+// aren't reseeded (or are reseeded with the same seed), which the
+// single-sample tests and the uniqueness database might miss if the
+// samples only partly overlap.
+
+import (
+	"appengine"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PairReport describes how similar samples A and B are
+type PairReport struct {
+	A            int      `json:"a"`
+	B            int      `json:"b"`
+	SharedPrefix int      `json:"sharedPrefix"` // Bytes
+	Distance     int      `json:"distance"`     // Hamming distance of the first Bits bits
+	Bits         int      `json:"bits"`
+	Correlated   bool     `json:"correlated"`
+	Reasons      []string `json:"reasons,omitempty"`
+}
+
+// Correlate compares every pair of samples. Like LooksRandom, each
+// test has a false positive rate under 1-in-2^fpBits() per pair.
+func Correlate(samples [][]byte) []PairReport {
+	var result []PairReport
+	for i := 0; i < len(samples); i++ {
+		for j := i + 1; j < len(samples); j++ {
+			result = append(result, correlatePair(i, samples[i], j, samples[j]))
+		}
+	}
+	return result
+}
+
+func correlatePair(i int, a []byte, j int, b []byte) PairReport {
+	p := PairReport{A: i, B: j}
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for p.SharedPrefix < n && a[p.SharedPrefix] == b[p.SharedPrefix] {
+		p.SharedPrefix++
+	}
+	for k := 0; k < n; k++ {
+		p.Distance += onesCount(a[k] ^ b[k])
+	}
+	p.Bits = 8 * n
+
+	// k shared bytes are 2^-8k, so getting under the budget takes a
+	// byte more than it has bits for
+	if p.SharedPrefix >= ceilDiv(fpBits(), 8)+1 {
+		p.Reasons = append(p.Reasons, "Shared prefix")
+	}
+	// Hoeffding: chance of the distance being t or more away from
+	// Bits/2 is under 2*exp(-2*t*t/Bits); under 1-in-2^fpBits needs
+	// t*t >= (fpBits+1)*ln(2)/2*Bits
+	t := math.Abs(float64(p.Distance) - float64(p.Bits)/2)
+	if p.Bits > 0 && t*t >= float64(fpBits()+1)*math.Ln2/2*float64(p.Bits) {
+		p.Reasons = append(p.Reasons, "Hamming distance")
+	}
+	if sharedWindow(a, b) {
+		p.Reasons = append(p.Reasons, "Shared 16-byte window")
+	}
+	p.Correlated = len(p.Reasons) > 0
+	return p
+}
+
+// Returns true if any 16-byte window of a appears anywhere in b
+func sharedWindow(a []byte, b []byte) bool {
+	for i := 0; i+16 <= len(a); i++ {
+		if bytes.Contains(b, a[i:i+16]) {
+			return true
+		}
+	}
+	return false
+}
+
+// POST two or more hex samples, one per line; the response is a JSON
+// array with a PairReport for every pair.
+func correlateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "correlate method must be POST")
+		return
+	}
+	const maxSamples = 16
+	var samples [][]byte
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, 64*1024))
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			sendError(w, r, http.StatusBadRequest, "invalid_hex", fmt.Sprintf("Invalid hex on line %d", line))
+			return
+		}
+		if len(b) < 16 {
+			sendError(w, r, http.StatusBadRequest, "too_short", fmt.Sprintf("Line %d: must provide 16 or more bytes", line))
+			return
+		}
+		samples = append(samples, b)
+	}
+	if err := scanner.Err(); err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_request", "Error reading request")
+		return
+	}
+	if len(samples) < 2 || len(samples) > maxSamples {
+		sendError(w, r, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Must provide 2 to %d samples", maxSamples))
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("correlate", clientIP(r, trustedProxies)), 60, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(Correlate(samples))
+}
@@ -0,0 +1,56 @@
+package randomsanity
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCorrelate(t *testing.T) {
+	var tests = []struct {
+		a, b    string
+		reasons string
+	}{
+		// Independent:
+		{"e47d253e45ccfa65f44493677aaf56ae", "be5d96f4a70273c960b3ce27997d6e38", ""},
+		{"13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a",
+			"4724b307af612288395831874016ede4f3ba2d41df40c3884f1ff1b9c05ac3", ""},
+		// Same seed, different amounts of output:
+		{"e47d253e45ccfa65f44493677aaf56ae", "e47d253e45ccfa65f44493677aaf56ae8b", "Shared prefix,Hamming distance,Shared 16-byte window"},
+		// Same first 9 bytes only:
+		{"e47d253e45ccfa65f44493677aaf56ae", "e47d253e45ccfa65f4b3ce27997d6e38", "Shared prefix"},
+		// ... 8 bytes is 2^-64, not under it:
+		{"e47d253e45ccfa65f44493677aaf56ae", "e47d253e45ccfa6560b3ce27997d6e38", ""},
+		// Overlapping, but not at the start:
+		{"be5d96f4a70273c9e47d253e45ccfa65f44493677aaf56ae", "e47d253e45ccfa65f44493677aaf56ae60b3ce27997d6e38", "Shared 16-byte window"},
+		// Bitwise complements:
+		{"e47d253e45ccfa65f44493677aaf56ae", "1b82dac1ba33059a0bbb6c988550a951", "Hamming distance"},
+	}
+	for _, test := range tests {
+		a, _ := hex.DecodeString(test.a)
+		b, _ := hex.DecodeString(test.b)
+		r := Correlate([][]byte{a, b})
+		if len(r) != 1 {
+			t.Fatalf("Correlate(%s, %s) returned %d reports", test.a, test.b, len(r))
+		}
+		got := strings.Join(r[0].Reasons, ",")
+		if got != test.reasons || r[0].Correlated != (test.reasons != "") {
+			t.Errorf("Correlate(%s, %s) = %q, want %q", test.a, test.b, got, test.reasons)
+		}
+	}
+
+	// The thresholds follow the false-positive budget
+	setFalsePositiveBits(48)
+	defer setFalsePositiveBits(defaultFalsePositiveBits)
+	a, _ := hex.DecodeString("e47d253e45ccfa65f44493677aaf56ae")
+	b, _ := hex.DecodeString("e47d253e45ccfa6560b3ce27997d6e38")
+	if r := Correlate([][]byte{a, b}); len(r[0].Reasons) == 0 || r[0].Reasons[0] != "Shared prefix" {
+		t.Errorf("Correlate at 48 bits = %q", r[0].Reasons)
+	}
+
+	// One report per pair:
+	s := [][]byte{make([]byte, 16), make([]byte, 16), make([]byte, 16), make([]byte, 16)}
+	if r := Correlate(s); len(r) != 6 || r[5].A != 2 || r[5].B != 3 {
+		t.Errorf("Correlate(4 samples) = %v", r)
+	}
+}
@@ -0,0 +1,114 @@
+package randomsanity
+
+// Estimate how many entries the uniqueness database holds, to help
+// decide whether prefixBytes or maxEntriesPerKey need changing.
+// Counting every entry would mean reading every bucket, so this
+// counts buckets (from the datastore's statistics if they exist)
+// and multiplies by the average fill of a random sample of them.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"math/rand" // don't need cryptographically secure randomness here
+	"net/http"
+)
+
+// How many buckets to read to estimate the average fill
+const dbSizeSampleBuckets = 50
+
+// Counting buckets is slow; give up and report "at least" this many
+const dbSizeMaxCount = 100000
+
+type DBSize struct {
+	Buckets         int64   // Number of RBH entities
+	BucketsAtLeast  bool    // true if Buckets was capped at dbSizeMaxCount
+	SampledBuckets  int     // Buckets read to compute AverageFill
+	AverageFill     float64 // Mean entries per sampled bucket
+	EstimateEntries int64   // Buckets * AverageFill
+}
+
+// The datastore's statistics entity for a kind (updated about once a day)
+type kindStat struct {
+	Count    int64  `datastore:"count"`
+	KindName string `datastore:"kind_name"`
+}
+
+// Returns the estimate of entries given the number of buckets and
+// the fill of each bucket sampled
+func estimateEntries(buckets int64, fills []int) (float64, int64) {
+	if len(fills) == 0 {
+		return 0, 0
+	}
+	total := 0
+	for _, f := range fills {
+		total += f
+	}
+	avg := float64(total) / float64(len(fills))
+	return avg, int64(avg*float64(buckets) + 0.5)
+}
+
+func countBuckets(ctx appengine.Context) (int64, bool, error) {
+	statKind := "__Stat_Kind__"
+	if len(namespace(ctx)) > 0 {
+		statKind = "__Stat_Ns_Kind__"
+	}
+	var stats []kindStat
+	_, err := datastore.NewQuery(statKind).Filter("kind_name =", "RBH").GetAll(ctx, &stats)
+	if err == nil && len(stats) > 0 {
+		return stats[0].Count, false, nil
+	}
+	// No statistics yet (or on the development server), count them:
+	n, err := datastore.NewQuery("RBH").KeysOnly().Limit(dbSizeMaxCount).Count(ctx)
+	return int64(n), n >= dbSizeMaxCount, err
+}
+
+// Returns the number of entries in up to dbSizeSampleBuckets buckets,
+// starting from a random key
+func sampleFills(ctx appengine.Context) ([]int, error) {
+	var fills []int
+	start := datastore.NewKey(ctx, "RBH", "", 1+rand.Int63n(int64(1)<<(8*prefixBytes)), nil)
+	queries := []*datastore.Query{
+		datastore.NewQuery("RBH").Filter("__key__ >=", start),
+		datastore.NewQuery("RBH").Filter("__key__ <", start), // Wrap around
+	}
+	for _, q := range queries {
+		var hits []RngUniqueBytes
+		if _, err := q.Limit(dbSizeSampleBuckets-len(fills)).GetAll(ctx, &hits); err != nil {
+			return nil, err
+		}
+		for _, h := range hits {
+			fills = append(fills, len(h.Hits))
+		}
+		if len(fills) >= dbSizeSampleBuckets {
+			break
+		}
+	}
+	return fills, nil
+}
+
+// GET returns a DBSize as JSON (pass ns=... for a namespace).
+// Only admins can call this (see app.yaml).
+func dbSizeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, err := namespaceContext(appengine.NewContext(r), r)
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_namespace", "Invalid namespace")
+		return
+	}
+	var result DBSize
+	result.Buckets, result.BucketsAtLeast, err = countBuckets(ctx)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	fills, err := sampleFills(ctx)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	result.SampledBuckets = len(fills)
+	result.AverageFill, result.EstimateEntries = estimateEntries(result.Buckets, fills)
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
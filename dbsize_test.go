@@ -0,0 +1,27 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+func TestEstimateEntries(t *testing.T) {
+	var tests = []struct {
+		buckets int64
+		fills   []int
+		avg     float64
+		want    int64
+	}{
+		{0, nil, 0, 0},
+		{1000, nil, 0, 0},
+		{1000, []int{1, 1, 1, 1}, 1, 1000},
+		{1000, []int{1, 2, 3, 4}, 2.5, 2500},
+		{3, []int{1, 2, 2}, 5.0 / 3, 5},
+		{1 << 32, []int{100}, 100, 100 << 32},
+	}
+	for _, test := range tests {
+		avg, got := estimateEntries(test.buckets, test.fills)
+		if avg != test.avg || got != test.want {
+			t.Errorf("estimateEntries(%d, %v) = %v, %d; want %v, %d", test.buckets, test.fills, avg, got, test.avg, test.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package randomsanity
+
+// Some users mean their bytes to be non-uniform (Gaussian noise from
+// a sensor, say), and fail statistics that assume every byte value is
+// equally likely. A registered user can declare the distribution they
+// expect; Measure's chi-square and Score then compare against it
+// instead, and their /v1/q verdicts skip those tests (see
+// LooksRandomAgainst).
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The chance of each byte value, 0 to 255; nil means uniform
+type Distribution []float64
+
+// The chance of byte value v
+func (d Distribution) p(v int) float64 {
+	if d == nil {
+		return 1.0 / 256
+	}
+	return d[v]
+}
+
+// Shannon entropy, bits per byte (8 for uniform)
+func (d Distribution) entropy() float64 {
+	e := 0.0
+	for v := 0; v < 256; v++ {
+		e -= d.p(v) * math.Log2(d.p(v))
+	}
+	return e
+}
+
+// LooksRandomAgainst is LooksRandom for bytes that should have
+// distribution d: unless d is uniform, the frequencyDetectors aren't
+// run. The tests for structure (counters, copies, text, ...) still are.
+func LooksRandomAgainst(b []byte, d Distribution) (bool, string) {
+	if d == nil {
+		return LooksRandom(b)
+	}
+	return looksRandom(b, frequencyDetectors)
+}
+
+// Returns the distribution s describes: "uniform", or a histogram of
+// 256 comma-separated positive weights (counts, say), one per byte value
+func parseDistribution(s string) (Distribution, error) {
+	if s == "uniform" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 256 {
+		return nil, fmt.Errorf("expected must be uniform or 256 weights, not %d", len(parts))
+	}
+	d := make(Distribution, 256)
+	total := 0.0
+	for v, str := range parts {
+		w, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil || !(w > 0) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("weight %d must be a positive number", v)
+		}
+		d[v] = w
+		total += w
+	}
+	for v := range d {
+		d[v] /= total
+	}
+	return d, nil
+}
+
+// Returns the registered user's declared distribution (nil if they
+// haven't declared one, or aren't registered)
+func userDistribution(ctx appengine.Context, uID string) (Distribution, error) {
+	dbKey, err := userID(ctx, uID)
+	if err != nil || dbKey == nil {
+		return nil, err
+	}
+	reg, err := registration(ctx, dbKey)
+	return reg.Distribution, err
+}
+
+// POST /v1/distribution/<id>?expected=... declares the distribution
+// user <id>'s bytes should have (see parseDistribution); expected=uniform
+// goes back to the default.
+func distributionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "distribution method must be POST")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
+		return
+	}
+	if len(parts) > 4 {
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
+		return
+	}
+	d, err := parseDistribution(r.FormValue("expected"))
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_distribution", err.Error())
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("distribution", clientIP(r, trustedProxies)), 10, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	dbKey, err := userID(ctx, parts[3])
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if dbKey == nil {
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
+		return
+	}
+
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
+	var n NotifyViaEmail
+	if err := datastore.Get(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	n.Distribution = d
+	if _, err := datastore.Put(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	fmt.Fprintf(w, "expected distribution: %.3f bits of entropy per byte\n", d.entropy())
+}
@@ -0,0 +1,130 @@
+package randomsanity
+
+import (
+	"encoding/hex"
+	"math"
+	mathrand "math/rand"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Bytes with mean 128 and standard deviation 20, like a noisy sensor
+func gaussian() Distribution {
+	weights := make([]string, 256)
+	for v := range weights {
+		x := (float64(v) - 128) / 20
+		weights[v] = strconv.FormatFloat(math.Exp(-x*x/2), 'g', -1, 64)
+	}
+	d, err := parseDistribution(strings.Join(weights, ","))
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// n bytes drawn from d
+func sample(r *mathrand.Rand, d Distribution, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		x := r.Float64()
+		v := 0
+		for ; v < 255 && x >= d.p(v); v++ {
+			x -= d.p(v)
+		}
+		b[i] = byte(v)
+	}
+	return b
+}
+
+func TestParseDistribution(t *testing.T) {
+	if d, err := parseDistribution("uniform"); d != nil || err != nil {
+		t.Errorf("parseDistribution(uniform) = %v, %v", d, err)
+	}
+	weights := strings.Repeat("1,", 255) + "3"
+	d, err := parseDistribution(weights)
+	if err != nil || !near(d.p(0), 1.0/258) || !near(d.p(255), 3.0/258) {
+		t.Errorf("parseDistribution(%s) = %v, %v", weights, d, err)
+	}
+	for _, s := range []string{"", "1,2,3", strings.Repeat("1,", 255) + "0",
+		strings.Repeat("1,", 255) + "-1", strings.Repeat("1,", 255) + "NaN", strings.Repeat("1,", 256) + "1"} {
+		if _, err := parseDistribution(s); err == nil {
+			t.Errorf("parseDistribution(%q) succeeded", s)
+		}
+	}
+	if e := Distribution(nil).entropy(); !near(e, 8) {
+		t.Errorf("uniform entropy = %v", e)
+	}
+}
+
+func TestScoreAgainst(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	g := gaussian()
+	for _, n := range []int{256, 4096} {
+		b := sample(r, g, n)
+		// Uniform-assuming tests fail it...
+		if got := Score(b); got > 0.1 {
+			t.Errorf("Score(%d Gaussian bytes) = %v", n, got)
+		}
+		// ... but it's what was declared
+		if got := ScoreAgainst(b, g); got < 0.9 {
+			t.Errorf("ScoreAgainst(%d Gaussian bytes, Gaussian) = %v", n, got)
+		}
+		m := MeasureAgainst(b, g)
+		if math.Abs(m.Entropy-m.ExpectedEntropy) > 0.5 {
+			t.Errorf("MeasureAgainst(%d Gaussian bytes) = %+v", n, m)
+		}
+		uniform := make([]byte, n)
+		r.Read(uniform)
+		if got := ScoreAgainst(uniform, g); got > 0.1 {
+			t.Errorf("ScoreAgainst(%d uniform bytes, Gaussian) = %v", n, got)
+		}
+		if got := ScoreAgainst(uniform, nil); got != Score(uniform) {
+			t.Errorf("ScoreAgainst(%d uniform bytes, uniform) = %v, Score = %v", n, got, Score(uniform))
+		}
+	}
+}
+
+// A declared distribution skips the tests that assume uniform bytes,
+// but not the ones that look for structure
+func TestLooksRandomAgainst(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	g := gaussian()
+	for _, n := range []int{16, 64, 256, 4096} {
+		b := sample(r, g, n)
+		if ok, reason := LooksRandomAgainst(b, g); !ok {
+			t.Errorf("LooksRandomAgainst(%d Gaussian bytes, Gaussian) = %v, %q", n, ok, reason)
+		}
+		wantOK, wantReason := LooksRandom(b)
+		if ok, reason := LooksRandomAgainst(b, nil); ok != wantOK || reason != wantReason {
+			t.Errorf("LooksRandomAgainst(%d Gaussian bytes, uniform) = %v, %q", n, ok, reason)
+		}
+		copied := append(append([]byte{}, b[:n/2]...), b[:n/2]...)
+		if ok, reason := LooksRandomAgainst(copied, g); ok || reason != "Duplicated buffer halves" {
+			t.Errorf("LooksRandomAgainst(%d copied Gaussian bytes) = %v, %q", n, ok, reason)
+		}
+		if got := ScoreAgainst(copied, g); got != 0 {
+			t.Errorf("ScoreAgainst(%d copied Gaussian bytes) = %v", n, got)
+		}
+	}
+	if ok, _ := LooksRandom(sample(r, g, 256)); ok {
+		t.Errorf("LooksRandom(256 Gaussian bytes) = true")
+	}
+	reasons := map[string]bool{}
+	for _, d := range detectors {
+		reasons[d.reason] = true
+	}
+	for reason := range frequencyDetectors {
+		if !reasons[reason] {
+			t.Errorf("frequencyDetectors has %q, which isn't a detector", reason)
+		}
+	}
+	// /v1/q verdicts use the declared distribution
+	b := sample(r, g, 64)
+	req := httptest.NewRequest("GET", "/v1/q/"+hex.EncodeToString(b), nil)
+	never := func([]byte) bool { return false }
+	if ok, reason := checkSubmission(req, b, b, 0, g, never); !ok {
+		t.Errorf("checkSubmission(Gaussian bytes, Gaussian) = %v, %q", ok, reason)
+	}
+}
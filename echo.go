@@ -0,0 +1,44 @@
+package randomsanity
+
+// For clients debugging their encoding: what bytes did the server
+// decode from a request? Nothing is tested or stored.
+
+import (
+	"appengine"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type echoResponse struct {
+	Bytes    int    `json:"bytes"`
+	Hex      string `json:"hex"`
+	TooShort bool   `json:"tooShort,omitempty"` // /v1/q would reject it (see submittedBytes)
+}
+
+// Returns what r's submission decodes to
+func echo(r *http.Request) (echoResponse, *inputError) {
+	b, e := parseSubmission(r)
+	if e != nil {
+		return echoResponse{}, e
+	}
+	return echoResponse{len(b), hex.EncodeToString(b), len(b) < minSubmissionBytes}, nil
+}
+
+// GET /v1/echo/<hex> or POST, with anything /v1/q accepts; the
+// response is an echoResponse as JSON, or the error /v1/q would send.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("echo", clientIP(r, trustedProxies)), 60, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	result, e := echo(r)
+	if e != nil {
+		sendError(w, r, e.status, e.code, e.msg)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
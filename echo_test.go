@@ -0,0 +1,46 @@
+package randomsanity
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	hex16 := "0f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	b64 := "Dx4tPEtaaXiHlqW0w9Lh8A==" // The same 16 bytes
+	var tests = []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        echoResponse
+		code        string
+	}{
+		{"GET", "/v1/echo/" + hex16, "", "", echoResponse{16, hex16, false}, ""},
+		{"GET", "/v1/echo/00ff", "", "", echoResponse{2, "00ff", true}, ""},
+		{"GET", "/v1/echo/?bytes=" + b64 + "&encoding=base64", "", "", echoResponse{16, hex16, false}, ""},
+		{"GET", "/v1/echo/Dx4tPEtaaXiHlqW0w9Lh8A?encoding=base64", "", "", echoResponse{16, hex16, false}, ""},
+		{"GET", "/v1/echo/_-8?encoding=base64", "", "", echoResponse{2, "ffef", true}, ""}, // URL-safe
+		{"POST", "/v1/echo", "text/plain", hex16 + "\n", echoResponse{16, hex16, false}, ""},
+		{"POST", "/v1/echo?encoding=base64", "text/plain", b64 + "\n", echoResponse{16, hex16, false}, ""},
+		{"POST", "/v1/echo", "application/octet-stream", "\x00\x01\xff", echoResponse{3, "0001ff", true}, ""},
+		{"GET", "/v1/echo/zz", "", "", echoResponse{}, "invalid_hex"},
+		{"GET", "/v1/echo/" + hex16 + "?encoding=base64x", "", "", echoResponse{}, "invalid_encoding"},
+		{"POST", "/v1/echo?encoding=base64", "text/plain", "Dx4t!", echoResponse{}, "invalid_base64"},
+		{"POST", "/v1/echo", "image/png", hex16, echoResponse{}, "unsupported_media_type"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		got, e := echo(r)
+		switch {
+		case test.code != "" && (e == nil || e.code != test.code):
+			t.Errorf("%s %s: got %+v %v, want %s", test.method, test.path, got, e, test.code)
+		case test.code == "" && (e != nil || got != test.want):
+			t.Errorf("%s %s: got %+v %v, want %+v", test.method, test.path, got, e, test.want)
+		}
+	}
+}
@@ -1,19 +1,121 @@
 package randomsanity
 
 import (
+	"appengine"
+	"appengine/memcache"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"net/http"
+	"time"
 )
 
-func addEntropyHeader(w http.ResponseWriter) {
+// How long to remember X-Entropy values, so clients that submit
+// them back can be told that isn't their own RNG's output
+const issuedEntropyExpiration = time.Hour
+
+// Clients can mix their own randomness into a pool (see
+// contributeHandler) that every X-Entropy value is hashed with; the
+// result is no worse than crypto/rand alone, even if the pool is
+// empty or every contribution was chosen by an attacker. Best-effort:
+// the pool lives in memcache.
+const entropyPoolKey = "entropypool"
+
+// Returns the pool after mixing in b
+func mixPool(pool []byte, b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("mix"))
+	h.Write(pool)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Returns an X-Entropy value from 32 fresh crypto/rand bytes and the pool
+func entropyFrom(random []byte, pool []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("entropy"))
+	h.Write(random)
+	h.Write(pool)
+	return h.Sum(nil)
+}
+
+// Where the pool and the recently issued X-Entropy values are kept:
+// memcache (memcacheEntropy), or memory in tests
+type entropyStore interface {
+	get(key string) ([]byte, bool)
+	set(key string, value []byte, expiration time.Duration)
+}
+
+type memcacheEntropy struct {
+	ctx appengine.Context
+}
+
+func (m memcacheEntropy) get(key string) ([]byte, bool) {
+	item, err := memcache.Get(m.ctx, key)
+	if err != nil {
+		return nil, false
+	}
+	return item.Value, true
+}
+
+// Best-effort; if memcache is down or evicts the key, that only loses
+// a contribution or an issued value
+func (m memcacheEntropy) set(key string, value []byte, expiration time.Duration) {
+	memcache.Set(m.ctx, &memcache.Item{Key: key, Value: value, Expiration: expiration})
+}
+
+func mixIntoEntropyPool(s entropyStore, b []byte) {
+	pool, _ := s.get(entropyPoolKey)
+	// Racing contributions can overwrite each other; that only loses
+	// a contribution, it doesn't weaken anything.
+	s.set(entropyPoolKey, mixPool(pool, b), 0)
+}
+
+func addEntropyHeader(s entropyStore, w http.ResponseWriter) {
 	// This assumes server has a good crypto/rand
-	// implementation. We could memcache an array
-	// that is initialized to crypto/rand but updated
-	// with every request that comes in with random data.
-	var b [32]byte
-	n, err := rand.Read(b[:])
-	if err == nil && n == len(b) {
-		w.Header().Add("X-Entropy", hex.EncodeToString(b[:]))
+	// implementation.
+	var r [32]byte
+	n, err := rand.Read(r[:])
+	if err == nil && n == len(r) {
+		pool, _ := s.get(entropyPoolKey)
+		h := hex.EncodeToString(entropyFrom(r[:], pool))
+		w.Header().Add("X-Entropy", h)
+		// If it's lost we just won't recognize it if it comes back
+		s.set("entropy"+h, []byte{1}, issuedEntropyExpiration)
+	}
+}
+
+// Returns true if b is an X-Entropy value we handed out recently
+func issuedEntropy(s entropyStore, b []byte) bool {
+	if len(b) != 32 {
+		return false
 	}
+	_, ok := s.get("entropy" + hex.EncodeToString(b))
+	return ok
+}
+
+// Mix the submitted bytes (like /v1/q, GET or POST) into the entropy
+// pool without testing them, and get a fresh X-Entropy back.
+// For clients that trust their RNG and want to help others.
+func contributeHandler(w http.ResponseWriter, r *http.Request) {
+	b, e := submittedBytes(r, minUniqueBytes)
+	if e != nil {
+		sendError(w, r, e.status, e.code, e.msg)
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("contribute", clientIP(r, trustedProxies)), 600, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	contribute(memcacheEntropy{ctx}, w, b)
+}
+
+// Everything /v1/contribute does once b is accepted. b isn't tested
+// statistically or looked up for uniqueness (without a context,
+// nothing here can reach the datastore), and isn't counted.
+func contribute(s entropyStore, w http.ResponseWriter, b []byte) {
+	mixIntoEntropyPool(s, b)
+	addEntropyHeader(s, w)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,133 @@
+package randomsanity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// An entropyStore in memory; expirations are ignored
+type memEntropy map[string][]byte
+
+func (m memEntropy) get(key string) ([]byte, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+func (m memEntropy) set(key string, value []byte, expiration time.Duration) {
+	m[key] = value
+}
+
+func TestEntropyPool(t *testing.T) {
+	contribution := []byte("0123456789abcdef")
+	pool := mixPool(nil, contribution)
+	if len(pool) != 32 {
+		t.Fatalf("pool is %d bytes", len(pool))
+	}
+	// Every contribution changes the pool, even a repeat
+	again := mixPool(pool, contribution)
+	if bytes.Equal(pool, again) {
+		t.Error("mixPool didn't change the pool")
+	}
+	if bytes.Equal(mixPool(nil, contribution), mixPool(nil, []byte("0123456789abcdeF"))) {
+		t.Error("different contributions gave the same pool")
+	}
+
+	random := bytes.Repeat([]byte{0x5a}, 32)
+	if bytes.Equal(entropyFrom(random, pool), entropyFrom(random, again)) {
+		t.Error("X-Entropy doesn't depend on the pool")
+	}
+	if bytes.Equal(entropyFrom(random, pool), entropyFrom(bytes.Repeat([]byte{0xa5}, 32), pool)) {
+		t.Error("X-Entropy doesn't depend on crypto/rand")
+	}
+	// X-Entropy must not give away the pool
+	if bytes.Equal(entropyFrom(random, pool), pool) {
+		t.Error("X-Entropy is the pool")
+	}
+}
+
+func TestContributeErrors(t *testing.T) {
+	// Same input rules as /v1/q; checked before anything else happens
+	for _, path := range []string{"/v1/contribute/xyz", "/v1/contribute/0011"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		contributeHandler(w, r)
+		if w.Code != http.StatusBadRequest || w.Header().Get("X-Entropy") != "" {
+			t.Errorf("%s: %d X-Entropy=%q", path, w.Code, w.Header().Get("X-Entropy"))
+		}
+	}
+}
+
+func TestContribute(t *testing.T) {
+	s := make(memEntropy)
+	pendingUsage.take(time.Now())
+	var pools [][]byte
+	send := func(b []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		contribute(s, w, b)
+		if w.Code != http.StatusNoContent || len(w.Header().Get("X-Entropy")) != 64 {
+			t.Errorf("contribute(%x): %d X-Entropy=%q", b, w.Code, w.Header().Get("X-Entropy"))
+		}
+		for _, h := range []string{"X-Result", "X-Warning", "X-Uniqueness"} {
+			if v := w.Header().Get(h); v != "" {
+				t.Errorf("contribute(%x): %s=%q", b, h, v)
+			}
+		}
+		pool := s[entropyPoolKey]
+		for _, p := range pools {
+			if bytes.Equal(p, pool) {
+				t.Errorf("contribute(%x) didn't change the pool", b)
+			}
+		}
+		pools = append(pools, pool)
+		return w
+	}
+	// Bytes that fail LooksRandom, and our own X-Entropy, are mixed in
+	// like any others
+	send(make([]byte, 32))
+	w := send(bytes.Repeat([]byte{0x5a}, 16))
+	issued, _ := hex.DecodeString(w.Header().Get("X-Entropy"))
+	send(issued)
+
+	// The pool, and one issued X-Entropy per call; nothing else
+	if len(s) != 1+len(pools) {
+		t.Errorf("store has %d keys, want %d", len(s), 1+len(pools))
+	}
+	if counts := pendingUsage.take(time.Now()); len(counts) != 0 {
+		t.Errorf("contribute() counted %v", counts)
+	}
+}
+
+// X-Entropy fed back to us is rejected, not tested
+func TestIssuedEntropy(t *testing.T) {
+	s := make(memEntropy)
+	w := httptest.NewRecorder()
+	addEntropyHeader(s, w)
+	issued, err := hex.DecodeString(w.Header().Get("X-Entropy"))
+	if err != nil || len(issued) != 32 {
+		t.Fatalf("X-Entropy = %q", w.Header().Get("X-Entropy"))
+	}
+	if !issuedEntropy(s, issued) {
+		t.Error("issuedEntropy(X-Entropy) = false")
+	}
+	if issuedEntropy(s, issued[:16]) || issuedEntropy(make(memEntropy), issued) {
+		t.Error("issuedEntropy() = true for bytes we didn't hand out")
+	}
+	other := append([]byte{}, issued...)
+	other[0] ^= 1
+	if issuedEntropy(s, other) {
+		t.Error("issuedEntropy() = true for different bytes")
+	}
+
+	r := httptest.NewRequest("GET", "/v1/q/"+hex.EncodeToString(issued), nil)
+	issuedFrom := func(b []byte) bool { return issuedEntropy(s, b) }
+	if ok, reason := checkSubmission(r, issued, issued, 0, nil, issuedFrom); ok || reason != "Server-provided entropy, not your RNG" {
+		t.Errorf("checkSubmission(X-Entropy) = %v, %q", ok, reason)
+	}
+	if ok, reason := checkSubmission(r, other, other, 0, nil, issuedFrom); !ok {
+		t.Errorf("checkSubmission(other) = %v, %q", ok, reason)
+	}
+}
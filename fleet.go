@@ -0,0 +1,84 @@
+package randomsanity
+
+// Hundreds of machines sharing a bad seed all submit the same bytes,
+// and each match would be a notification of its own. Matches are
+// counted per matched value (by its hash, in the uniqueness
+// database's namespace): once fleetThreshold different sources (a
+// registered user's tags, or addresses for anonymous clients) have
+// matched it within fleetWindow, the users involved get one summary
+// instead, and there are no more notifications about it until the
+// window is over.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	fleetThreshold = 10
+	fleetWindow    = time.Hour
+)
+
+// Entities in the 'FleetSources' datastore, keyed by the hex of the
+// matched window's hash
+type FleetSources struct {
+	Sources   []string `datastore:",noindex"` // Hashes (see fleetSource), until Escalated
+	Start     int64    `datastore:",noindex"` // When the window started
+	Escalated bool     `datastore:",noindex"`
+}
+
+// Counts source as having matched at time now. Returns whether the
+// match should be notified on its own, and whether it is the one that
+// makes this a fleet-wide collision (and the summary should be sent).
+func (c *FleetSources) add(source string, now int64) (bool, bool) {
+	if now-c.Start >= int64(fleetWindow/time.Second) {
+		*c = FleetSources{Start: now}
+	}
+	if c.Escalated {
+		return false, false
+	}
+	seen := false
+	for _, s := range c.Sources {
+		seen = seen || s == source
+	}
+	if !seen {
+		c.Sources = append(c.Sources, source)
+	}
+	if len(c.Sources) >= fleetThreshold {
+		c.Escalated = true
+		c.Sources = nil // Not needed any more
+		return false, true
+	}
+	return true, false
+}
+
+// Identifies who submitted a match, without storing their ID, tag or
+// address
+func fleetSource(secret []byte, uID string, tag string, ip string) string {
+	s := "ip:" + ip
+	if len(uID) > 0 {
+		s = "user:" + uID + "/" + tag
+	}
+	return hex.EncodeToString(hash16(secret, []byte("fleet:"+s)))
+}
+
+// Counts a match of the window with hash hash (see FleetSources.add)
+func countFleetMatch(ctx appengine.Context, hash []byte, source string) (bool, bool, error) {
+	key := datastore.NewKey(ctx, "FleetSources", hex.EncodeToString(hash), 0, nil)
+	var each, escalate bool
+	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		var c FleetSources
+		if err := datastore.Get(ctx, key, &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		each, escalate = c.add(source, time.Now().Unix())
+		if !each && !escalate {
+			return nil // Already escalated; nothing changed
+		}
+		_, err := datastore.Put(ctx, key, &c)
+		return err
+	}, nil)
+	return each, escalate, err
+}
@@ -0,0 +1,81 @@
+package randomsanity
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 200 VMs behind different addresses, all submitting the same bytes
+func TestFleetSources(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	var c FleetSources
+	now := int64(1500000000)
+	each, alerts := 0, 0
+	for i := 0; i < 200; i++ {
+		source := fleetSource(secret, "", "", "192.0.2."+strconv.Itoa(i))
+		e, escalate := c.add(source, now+int64(i))
+		if e {
+			each++
+		}
+		if escalate {
+			alerts++
+		}
+	}
+	if each != fleetThreshold-1 || alerts != 1 {
+		t.Errorf("%d notifications and %d summaries, want %d and 1", each, alerts, fleetThreshold-1)
+	}
+
+	// The same source again and again is only one
+	c = FleetSources{}
+	source := fleetSource(secret, "alice", "prod", "192.0.2.1")
+	for i := 0; i < 2*fleetThreshold; i++ {
+		if e, escalate := c.add(source, now); !e || escalate {
+			t.Fatalf("match %d from one source: %v, %v", i, e, escalate)
+		}
+	}
+
+	// Once the window is over, matches are notified again
+	c = FleetSources{}
+	for i := 0; i < fleetThreshold; i++ {
+		c.add(fleetSource(secret, "alice", "vm"+strconv.Itoa(i), "192.0.2.1"), now)
+	}
+	if e, _ := c.add(source, now+60); e {
+		t.Error("notified after escalation")
+	}
+	if e, escalate := c.add(source, now+int64(fleetWindow.Seconds())); !e || escalate {
+		t.Errorf("after the window: %v, %v", e, escalate)
+	}
+}
+
+func TestFleetSource(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	sources := map[string]bool{}
+	for _, s := range [][3]string{
+		{"", "", "192.0.2.1"},
+		{"", "", "192.0.2.2"},
+		{"alice", "prod", "192.0.2.1"},
+		{"alice", "staging", "192.0.2.1"},
+		{"bob", "prod", "192.0.2.1"},
+	} {
+		h := fleetSource(secret, s[0], s[1], s[2])
+		if sources[h] || strings.Contains(h, "192") {
+			t.Errorf("fleetSource(%q) = %s", s, h)
+		}
+		sources[h] = true
+	}
+	// Registered users are one source wherever they submit from
+	if fleetSource(secret, "alice", "prod", "192.0.2.1") != fleetSource(secret, "alice", "prod", "198.51.100.7") {
+		t.Error("fleetSource depends on a registered user's address")
+	}
+}
+
+func TestFleetEmail(t *testing.T) {
+	body := failureEmailBody("", failure{Tag: "prod", Reason: "Non Unique", Sources: fleetThreshold})
+	if !strings.Contains(body, strconv.Itoa(fleetThreshold)+" or more different sources") {
+		t.Errorf("failureEmailBody = %q", body)
+	}
+	if strings.Contains(failureEmailBody("", failure{Reason: "Non Unique"}), "sources") {
+		t.Error("failureEmailBody mentions sources for one match")
+	}
+}
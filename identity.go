@@ -0,0 +1,105 @@
+package randomsanity
+
+// For operators who must not store user IDs and tags (which can
+// contain hostnames) in the uniqueness database: with
+// Settings.HashIdentities on, the RBH entries hold salted hashes of
+// them instead. Matching only compares them for equality, so verdicts
+// don't change. What has to stay reversible is who the earlier
+// submitter was, to notify them (and the tag to tell them); that needs
+// Settings.KeepIdentityLookup, a hash -> value table kept next to the
+// entries. Without it a match is still reported to the submitter, but
+// the earlier submitter isn't told.
+//
+// Entries stored before hashing was turned on keep the plain ID and
+// tag, and those stored while it was on keep the hashes if it is
+// turned off again: unique() treats a user's plain and hashed ID as
+// the same user, and reconcile.go clears both.
+//
+// Registrations and notification records (see audit.go) still hold
+// the real ID and tag: they exist to deliver and review notifications.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/hex"
+	"log"
+)
+
+// Stored hashes start with this, so values stored before
+// Settings.HashIdentities was turned on (and seedTag) are left alone
+const identityHashPrefix = "h:"
+
+// Returns what the uniqueness database stores for user ID or tag v:
+// v itself, or if hashed a salted hash of it. "" (anonymous) stays "".
+func storedIdentity(secret []byte, v string, hashed bool) string {
+	if !hashed || len(v) == 0 {
+		return v
+	}
+	return identityHashPrefix + hex.EncodeToString(hash16(secret, []byte("identity:"+v)))
+}
+
+// Returns registered (a set of user IDs) plus what's stored for each
+// of them, so reconcile.go doesn't clear hashed entries
+func storedUsers(secret []byte, registered map[string]bool, hashed bool) map[string]bool {
+	result := make(map[string]bool, 2*len(registered))
+	for id := range registered {
+		result[id] = true
+		result[storedIdentity(secret, id, hashed)] = true
+	}
+	return result
+}
+
+// Entries stored before Settings.HashIdentities was turned on (or
+// after it was turned off) hold the submitter's ID as other, not sUID;
+// this makes them sUID in found, so they still count as SameUser
+func sameIdentity(found []*RngUniqueBytesEntry, sUID string, other string) {
+	if len(sUID) == 0 {
+		return // Anonymous
+	}
+	for _, e := range found {
+		if e != nil && e.UserID == other {
+			e.UserID = sUID
+		}
+	}
+}
+
+// Entities in the 'StoredIdentity' datastore, keyed by the hash
+type StoredIdentity struct {
+	Value string `datastore:",noindex"`
+}
+
+// Returns the stored form of v (see storedIdentity), saving the
+// reverse mapping if settings.KeepIdentityLookup is on
+func storeIdentity(ctx appengine.Context, secret []byte, v string, settings Settings) string {
+	s := storedIdentity(secret, v, settings.HashIdentities)
+	if settings.KeepIdentityLookup && s != v {
+		k := datastore.NewKey(ctx, "StoredIdentity", s, 0, nil)
+		if _, err := datastore.Put(ctx, k, &StoredIdentity{v}); err != nil {
+			log.Printf("Datastore error storing identity: %s", err.Error())
+		}
+	}
+	return s
+}
+
+// Returns the real value of stored user ID or tag s, or "" if it is a
+// hash that can't be looked up
+func revealIdentity(ctx appengine.Context, s string, settings Settings) string {
+	return reveal(s, func(h string) (string, bool) {
+		if !settings.KeepIdentityLookup {
+			return "", false
+		}
+		var id StoredIdentity
+		err := datastore.Get(ctx, datastore.NewKey(ctx, "StoredIdentity", h, 0, nil), &id)
+		return id.Value, err == nil
+	})
+}
+
+func reveal(s string, lookup func(string) (string, bool)) string {
+	if len(s) <= len(identityHashPrefix) || s[:len(identityHashPrefix)] != identityHashPrefix {
+		return s
+	}
+	if v, ok := lookup(s); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package randomsanity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoredIdentity(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	if got := storedIdentity(secret, "db1.example.com", false); got != "db1.example.com" {
+		t.Errorf("storedIdentity(not hashed) = %q", got)
+	}
+	if got := storedIdentity(secret, "", true); got != "" {
+		t.Errorf("storedIdentity(\"\") = %q", got)
+	}
+	h := storedIdentity(secret, "db1.example.com", true)
+	if !strings.HasPrefix(h, identityHashPrefix) || strings.Contains(h, "example") {
+		t.Errorf("storedIdentity(hashed) = %q", h)
+	}
+	if storedIdentity(secret, "db1.example.com", true) != h {
+		t.Error("storedIdentity isn't deterministic")
+	}
+	if storedIdentity([]byte("fedcba9876543210"), "db1.example.com", true) == h {
+		t.Error("storedIdentity ignores the secret")
+	}
+}
+
+// Entries stored with hashed IDs and tags match, and give the same
+// verdict, as plain ones
+func TestHashedMatch(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	b := make([]byte, 64)
+	for i := range b {
+		b[i] = byte(i*37 + 11)
+	}
+	offsets := windowOffsets(len(b), 1)
+	n := len(offsets)
+	chunks := windowChunks(secret, b, offsets)
+	vals := make([]*RngUniqueBytes, n)
+	for i := range vals {
+		vals[i] = new(RngUniqueBytes)
+	}
+	alice := storedIdentity(secret, "alice", true)
+	aliceTag := storedIdentity(secret, "db1.example.com", true)
+	for _, i := range []int{0, n - 1} {
+		vals[i].Hits = []RngUniqueBytesEntry{{Trailing: chunks[i][prefixBytes:], UserID: alice, Tag: aliceTag}}
+	}
+	found, first := matchWindows(chunks, vals)
+	if first != 0 {
+		t.Fatalf("matchWindows: first match %d, want 0", first)
+	}
+
+	m := newMatch(found, first, n, b[:16], storedIdentity(secret, "bob", true))
+	if m.SameUser || !m.Common || m.Entry.Tag != aliceTag {
+		t.Errorf("bob's match = %+v", m)
+	}
+	if reason, _ := matchReport(m); reason != "Non Unique" {
+		t.Errorf("reason = %q", reason)
+	}
+	m = newMatch(found, first, n, b[:16], storedIdentity(secret, "alice", true))
+	if !m.SameUser || m.Common {
+		t.Errorf("alice's match = %+v", m)
+	}
+	// Same user, but hashed with another namespace's secret
+	if newMatch(found, first, n, b[:16], storedIdentity([]byte("fedcba9876543210"), "alice", true)).SameUser {
+		t.Error("SameUser across secrets")
+	}
+
+	// Alice's entries from before hashing was turned on
+	for _, i := range []int{0, n - 1} {
+		vals[i].Hits[0].UserID = "alice"
+	}
+	found, first = matchWindows(chunks, vals)
+	sameIdentity(found, alice, storedIdentity(secret, "alice", false))
+	if m := newMatch(found, first, n, b[:16], alice); !m.SameUser || m.Common {
+		t.Errorf("alice's match of her plain entries = %+v", m)
+	}
+	found, first = matchWindows(chunks, vals)
+	sameIdentity(found, storedIdentity(secret, "bob", true), "bob")
+	if m := newMatch(found, first, n, b[:16], storedIdentity(secret, "bob", true)); m.SameUser || !m.Common {
+		t.Errorf("bob's match of alice's plain entries = %+v", m)
+	}
+}
+
+func TestReveal(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	h := storedIdentity(secret, "db1.example.com", true)
+	table := map[string]string{h: "db1.example.com"}
+	lookup := func(s string) (string, bool) {
+		v, ok := table[s]
+		return v, ok
+	}
+	var tests = []struct {
+		stored string
+		want   string
+	}{
+		{h, "db1.example.com"},
+		{storedIdentity(secret, "other", true), ""}, // Not in the table
+		{seedTag, seedTag},
+		{"prod", "prod"}, // Stored before hashing was turned on
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := reveal(test.stored, lookup); got != test.want {
+			t.Errorf("reveal(%q) = %q, want %q", test.stored, got, test.want)
+		}
+	}
+}
+
+func TestStoredUsersReconcile(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	hits := []RngUniqueBytesEntry{
+		{Trailing: []byte{1}, UserID: storedIdentity(secret, "still", true), Tag: storedIdentity(secret, "prod", true)},
+		{Trailing: []byte{2}, UserID: storedIdentity(secret, "gone", true), Tag: storedIdentity(secret, "prod", true)},
+		{Trailing: []byte{3}, UserID: "still"},
+	}
+	registered := storedUsers(secret, map[string]bool{"still": true}, true)
+	if n := clearOrphans(hits, registered); n != 1 || len(hits[0].UserID) == 0 || len(hits[1].UserID) != 0 || hits[2].UserID != "still" {
+		t.Errorf("clearOrphans() = %d, %+v", n, hits)
+	}
+}
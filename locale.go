@@ -0,0 +1,76 @@
+package randomsanity
+
+// Error messages people are likely to see, translated. Programs
+// should look at the error code, which is never translated.
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var translations = map[string]map[string]string{
+	"de": {
+		"Invalid GET":                   "Ungültige Anfrage",
+		"Invalid hex":                   "Ungültige Hexadezimalzahl",
+		"Must provide 16 or more bytes": "Mindestens 16 Bytes erforderlich",
+		"Must provide 8 or more bytes":  "Mindestens 8 Bytes erforderlich",
+		"Request limit exceeded":        "Anfragelimit überschritten",
+		"Invalid namespace":             "Ungültiger Namensraum",
+	},
+	"es": {
+		"Invalid GET":                   "Solicitud no válida",
+		"Invalid hex":                   "Hexadecimal no válido",
+		"Must provide 16 or more bytes": "Se requieren al menos 16 bytes",
+		"Must provide 8 or more bytes":  "Se requieren al menos 8 bytes",
+		"Request limit exceeded":        "Límite de solicitudes excedido",
+		"Invalid namespace":             "Espacio de nombres no válido",
+	},
+	"fr": {
+		"Invalid GET":                   "Requête invalide",
+		"Invalid hex":                   "Hexadécimal invalide",
+		"Must provide 16 or more bytes": "Au moins 16 octets sont requis",
+		"Must provide 8 or more bytes":  "Au moins 8 octets sont requis",
+		"Request limit exceeded":        "Limite de requêtes dépassée",
+		"Invalid namespace":             "Espace de noms invalide",
+	},
+}
+
+// Returns the language in acceptLanguage (an Accept-Language header)
+// we have translations for with the highest weight, or "" for English
+func preferredLanguage(acceptLanguage string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexByte(lang, '-'); i >= 0 {
+			lang = lang[:i] // de-CH is de
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if lang == "en" && q > bestQ {
+			best, bestQ = "", q
+		}
+		if _, ok := translations[lang]; ok && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// Returns msg in the language r asks for, if there's a translation
+func localize(w http.ResponseWriter, r *http.Request, msg string) string {
+	lang := preferredLanguage(r.Header.Get("Accept-Language"))
+	if t, ok := translations[lang][msg]; ok {
+		w.Header().Set("Content-Language", lang)
+		return t
+	}
+	return msg
+}
@@ -0,0 +1,62 @@
+package randomsanity
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	var tests = []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", ""},
+		{"de", "de"},
+		{"de-CH, de;q=0.9", "de"},
+		{"FR-ca", "fr"},
+		{"ja, es;q=0.5", "es"},
+		{"en, fr;q=0.8", ""},
+		{"fr;q=0.5, es;q=0.7", "es"},
+		{"ja, zh", ""}, // No translations, so English
+	}
+	for _, test := range tests {
+		if got := preferredLanguage(test.acceptLanguage); got != test.want {
+			t.Errorf("preferredLanguage(%q) = %q, want %q", test.acceptLanguage, got, test.want)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	var tests = []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"de", "Ungültige Hexadezimalzahl"},
+		{"es-MX", "Hexadecimal no válido"},
+		{"ja", "Invalid hex"},
+		{"", "Invalid hex"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/q/xyz", nil)
+		r.Header.Set("Accept-Language", test.acceptLanguage)
+		w := httptest.NewRecorder()
+		submitBytesHandler(w, r)
+		var e errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatalf("body = %s", w.Body.String())
+		}
+		if w.Code != http.StatusBadRequest || e.Code != "invalid_hex" || e.Error != test.want {
+			t.Errorf("Accept-Language %q: %d %+v, want %q", test.acceptLanguage, w.Code, e, test.want)
+		}
+	}
+
+	// Messages without a translation stay English
+	r := httptest.NewRequest("GET", "/v1/q/00", nil)
+	r.Header.Set("Accept-Language", "fr")
+	w := httptest.NewRecorder()
+	if got := localize(w, r, "Datastore error"); got != "Datastore error" || w.Header().Get("Content-Language") != "" {
+		t.Errorf("localize(Datastore error) = %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+package randomsanity
+
+// Raw statistics, for people who want to apply their own thresholds
+// instead of LooksRandom's pass/fail. They compare against uniform
+// bytes, or the distribution a registered user declared (see
+// distribution.go).
+
+import (
+	"appengine"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Measurements describes the distribution of bits and bytes in a sample.
+// None of these say anything about random-looking output from a
+// deterministic generator; a counter scores perfectly on most of them.
+type Measurements struct {
+	Bytes         int     `json:"bytes"`
+	OnesFraction  float64 `json:"onesFraction"`  // Fraction of bits set; 0.5 is balanced
+	DistinctBytes int     `json:"distinctBytes"` // Number of different byte values seen
+	Entropy       float64 `json:"entropy"`       // Shannon entropy of the byte frequencies, bits per byte (8 at most)
+	ChiSquare     float64 `json:"chiSquare"`     // Byte frequencies against the expected distribution, 255 degrees of freedom
+	// Shannon entropy of the expected distribution: what Entropy
+	// should be, near enough, for a long sample
+	ExpectedEntropy float64 `json:"expectedEntropy"`
+}
+
+// Measure computes Measurements for b against uniform bytes; it makes
+// no judgment about them.
+func Measure(b []byte) Measurements {
+	return MeasureAgainst(b, nil)
+}
+
+// MeasureAgainst computes Measurements for b, which should have
+// distribution d.
+func MeasureAgainst(b []byte, d Distribution) Measurements {
+	m := Measurements{Bytes: len(b), ExpectedEntropy: d.entropy()}
+	if len(b) == 0 {
+		return m
+	}
+	var counts [256]int
+	ones := 0
+	for _, v := range b {
+		counts[v]++
+		ones += onesCount(v)
+	}
+	m.OnesFraction = float64(ones) / float64(8*len(b))
+
+	n := float64(len(b))
+	for v, c := range counts {
+		expected := n * d.p(v)
+		diff := float64(c) - expected
+		m.ChiSquare += diff * diff / expected
+		if c == 0 {
+			continue
+		}
+		m.DistinctBytes++
+		p := float64(c) / n
+		m.Entropy -= p * math.Log2(p)
+	}
+	return m
+}
+
+// Score returns a heuristic 0 to 1 "looks random" score for b, for
+// clients that want to pick their own threshold. It is 0 if b fails
+// LooksRandom; otherwise it is reduced (toward 0) if the bit balance,
+// or for 1280 or more bytes the byte frequencies, would happen less
+// than 1% of the time for random bytes. It is not a p-value, and says
+// nothing about uniqueness. Random bytes score 1 about 98% of the time.
+func Score(b []byte) float64 {
+	return ScoreAgainst(b, nil)
+}
+
+// ScoreAgainst is Score for bytes that should have distribution d: it
+// is 0 if b fails LooksRandomAgainst, and the byte frequencies are
+// checked for the values expected 5 or more times (the rest are
+// counted together).
+func ScoreAgainst(b []byte, d Distribution) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	if ok, _ := LooksRandomAgainst(b, d); !ok {
+		return 0
+	}
+	var counts [256]int
+	for _, v := range b {
+		counts[v]++
+	}
+	// Normal approximations of the two-sided chances. Bits set per
+	// byte: mean 4 and variance 2 for uniform bytes.
+	n := float64(len(b))
+	mean, square, ones := 0.0, 0.0, 0.0
+	for v, c := range counts {
+		k := float64(onesCount(byte(v)))
+		mean += d.p(v) * k
+		square += d.p(v) * k * k
+		ones += float64(c) * k
+	}
+	score := 1.0
+	if variance := square - mean*mean; variance > 0 {
+		z := (ones - n*mean) / math.Sqrt(n*variance)
+		score = math.Min(1, math.Erfc(math.Abs(z)/math.Sqrt2)/0.01)
+	}
+	chiSquare, cells := 0.0, 0
+	restCount, restExpected := 0.0, 0.0
+	for v, c := range counts {
+		expected := n * d.p(v)
+		if expected < 5 {
+			restCount, restExpected = restCount+float64(c), restExpected+expected
+			continue
+		}
+		diff := float64(c) - expected
+		chiSquare, cells = chiSquare+diff*diff/expected, cells+1
+	}
+	if restExpected >= 5 {
+		diff := restCount - restExpected
+		chiSquare, cells = chiSquare+diff*diff/restExpected, cells+1
+	}
+	if cells >= 2 {
+		// Wilson-Hilferty, cells-1 degrees of freedom (255 for uniform
+		// bytes); too even is as suspicious as too uneven
+		k := float64(cells - 1)
+		z := (math.Cbrt(chiSquare/k) - (1 - 2/(9*k))) / math.Sqrt(2/(9*k))
+		score *= math.Min(1, math.Erfc(math.Abs(z)/math.Sqrt2)/0.01)
+	}
+	return score
+}
+
+// GET /v1/measure/<hex> or POST (like /v1/q); the response is
+// Measurements as JSON. Registered users can add id=... to measure
+// against the distribution they declared.
+func measureHandler(w http.ResponseWriter, r *http.Request) {
+	b, e := submittedBytes(r, minUniqueBytes)
+	if e != nil {
+		sendError(w, r, e.status, e.code, e.msg)
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("measure", clientIP(r, trustedProxies)), 60, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	d, err := userDistribution(ctx, r.FormValue("id"))
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MeasureAgainst(b, d))
+}
@@ -0,0 +1,73 @@
+package randomsanity
+
+import (
+	"encoding/hex"
+	"math"
+	mathrand "math/rand"
+	"testing"
+)
+
+func TestMeasure(t *testing.T) {
+	var tests = []struct {
+		hexbytes string
+		want     Measurements
+	}{
+		{"", Measurements{}},
+		// Chi-square is 256*sum(count^2)/n - n, so 255*n for a constant fill
+		{"00000000000000000000000000000000", Measurements{16, 0, 1, 0, 4080, 8}},
+		{"ffffffffffffffff", Measurements{8, 1, 1, 0, 2040, 8}},
+		// Two values, equally often: one bit of entropy per byte
+		{"00ff00ff00ff00ff", Measurements{8, 0.5, 2, 1, 256*32/8.0 - 8, 8}},
+		// Four values: two bits per byte; each has one bit set
+		{"01020408", Measurements{4, 0.125, 4, 2, 252, 8}},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(test.hexbytes)
+		if err != nil {
+			panic(err)
+		}
+		got := Measure(b)
+		if got.Bytes != test.want.Bytes || got.DistinctBytes != test.want.DistinctBytes ||
+			!near(got.OnesFraction, test.want.OnesFraction) || !near(got.Entropy, test.want.Entropy) ||
+			!near(got.ChiSquare, test.want.ChiSquare) {
+			t.Errorf("Measure(%s) = %+v, want %+v", test.hexbytes, got, test.want)
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestScore(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	for _, n := range []int{16, 64, 256, 4096} {
+		b := make([]byte, n)
+		r.Read(b)
+		if got := Score(b); got < 0.9 {
+			t.Errorf("Score(%d random bytes) = %v", n, got)
+		}
+	}
+	var tests = []string{
+		"",
+		"00000000000000000000000000000000",
+		"000102030405060708090a0b0c0d0e0f",
+		// Passes LooksRandom, but 1 bits outnumber 0 bits 4 to 1
+		"f7bfedfb7bdef7bbdf7def5bfe77b7df",
+	}
+	for _, h := range tests {
+		b, _ := hex.DecodeString(h)
+		if got := Score(b); got > 0.1 {
+			t.Errorf("Score(%s) = %v", h, got)
+		}
+	}
+	// Bytes all 256 values exactly 5 times: too even
+	even := make([]byte, 5*256)
+	for i := range even {
+		even[i] = byte(i * 77)
+	}
+	r.Shuffle(len(even), func(i, j int) { even[i], even[j] = even[j], even[i] })
+	if got := Score(even); got > 0.1 {
+		t.Errorf("Score(every value 5 times) = %v", got)
+	}
+}
@@ -0,0 +1,44 @@
+package randomsanity
+
+// One instance can serve several independent products: passing
+// ns=<name> keeps the uniqueness database and usage counts for
+// each product separate, using App Engine namespaces.
+//
+// Registrations (and so notifications) and rate limits are shared by
+// all namespaces; otherwise a client could get a fresh rate limit just
+// by picking a new namespace.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"errors"
+	"net/http"
+)
+
+// Returns a context for the namespace requested by r
+// (or ctx if no namespace was requested)
+func namespaceContext(ctx appengine.Context, r *http.Request) (appengine.Context, error) {
+	ns := r.FormValue("ns")
+	if len(ns) == 0 {
+		return ctx, nil
+	}
+	if reservedNamespace(ns) {
+		return nil, errors.New("reserved namespace")
+	}
+	return appengine.Namespace(ctx, ns)
+}
+
+// Returns ctx's namespace ("" for the default namespace)
+func namespace(ctx appengine.Context) string {
+	// Keys pick up the context's namespace
+	return datastore.NewKey(ctx, "Namespace", "x", 0, nil).Namespace()
+}
+
+// Returns a context for the default namespace
+func defaultNamespace(ctx appengine.Context) appengine.Context {
+	c, err := appengine.Namespace(ctx, "")
+	if err != nil {
+		return ctx // Can't happen, "" is always valid
+	}
+	return c
+}
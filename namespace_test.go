@@ -0,0 +1,41 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+// The same bytes submitted to two namespaces: each namespace has its
+// own secret, so its own keys, and one's entries never match the other's
+func TestNamespacesDontCollide(t *testing.T) {
+	var c secretStore
+	load := func() ([]byte, error) {
+		secret, _, err := pickSecret(nil, uniqueReadWrite)
+		return secret, err
+	}
+	secretA, _ := c.get("productA", load)
+	secretB, _ := c.get("productB", load)
+
+	b := make([]byte, 32)
+	for i := range b {
+		b[i] = byte(i*37 + 11)
+	}
+	offsets := windowOffsets(len(b), 1)
+	chunksA := windowChunks(secretA, b, offsets)
+	chunksB := windowChunks(secretB, b, offsets)
+
+	// Everything product A stored for b, whatever its bucket in product B
+	stored := new(RngUniqueBytes)
+	for _, chunk := range chunksA {
+		stored.Hits = append(stored.Hits, RngUniqueBytesEntry{Trailing: chunk[prefixBytes:], UserID: "alice"})
+	}
+	vals := make([]*RngUniqueBytes, len(chunksB))
+	for i := range vals {
+		vals[i] = stored
+	}
+	if _, first := matchWindows(chunksB, vals); first >= 0 {
+		t.Errorf("product B matched product A's window %d", first)
+	}
+	if _, first := matchWindows(chunksA, vals); first != 0 {
+		t.Errorf("product A didn't match its own entries (first = %d)", first)
+	}
+}
@@ -18,8 +18,12 @@ import netmail "net/mail"
 // Code to notify customer when a rng failure is detected
 
 type NotifyViaEmail struct {
-	UserID  string
-	Address string
+	UserID        string
+	Address       string
+	Org           string         // See org.go
+	TagRateLimits []TagRateLimit `datastore:",noindex"` // See taglimit.go
+	Distribution  Distribution   `datastore:",noindex"` // See distribution.go
+	Contacts      []Contact      `datastore:",noindex"` // See contact.go
 }
 
 // Return userID associated with request (or empty string)
@@ -29,6 +33,7 @@ func userID(ctx appengine.Context, id string) (*datastore.Key, error) {
 	if len(id) == 0 {
 		return nil, nil
 	}
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
 	q := datastore.NewQuery("NotifyViaEmail").Filter("UserID =", id).Limit(1).KeysOnly()
 	keys, err := q.GetAll(ctx, nil)
 	if err != nil || len(keys) == 0 {
@@ -44,29 +49,29 @@ func userID(ctx appengine.Context, id string) (*datastore.Key, error) {
 func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 	// Requests generated by web browsers are not allowed:
 	if r.Header.Get("Origin") != "" {
-		http.Error(w, "CORS requests are not allowed", http.StatusForbidden)
+		sendError(w, r, http.StatusForbidden, "cors_forbidden", "CORS requests are not allowed")
 		return
 	}
 	ua := r.Header.Get("User-Agent")
 	if len(ua) < 4 || (!strings.EqualFold(ua[0:4], "curl") && !strings.EqualFold(ua[0:4], "wget")) {
-		http.Error(w, "Email registration must be done via curl or wget", http.StatusForbidden)
+		sendError(w, r, http.StatusForbidden, "curl_required", "Email registration must be done via curl or wget")
 		return
 	}
 
 	w.Header().Add("Content-Type", "text/plain")
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 4 {
-		http.Error(w, "Missing email", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "missing_email", "Missing email")
 		return
 	}
 	if len(parts) > 4 {
-		http.Error(w, "URL path too long", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
 		return
 	}
 
 	addresses, err := netmail.ParseAddressList(parts[len(parts)-1])
 	if err != nil || len(addresses) != 1 {
-		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "invalid_email", "Invalid email address")
 		return
 	}
 	address := addresses[0]
@@ -74,18 +79,18 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
 	// 2 registrations per IP per day
-	limited, err := RateLimitResponse(ctx, w, IPKey("emailreg", r.RemoteAddr), 2, time.Hour*24)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("emailreg", clientIP(r, trustedProxies)), 2, time.Hour*24)
 	if err != nil || limited {
 		return
 	}
 	// ... and 1 per email per week
-	limited, err = RateLimitResponse(ctx, w, "emailreg"+address.Address, 1, time.Hour*24*7)
+	limited, err = RateLimitResponse(ctx, w, r, "emailreg"+address.Address, 1, time.Hour*24*7)
 	if err != nil || limited {
 		return
 	}
 	// ... and global 10 signups per hour (so a botnet with lots of IPs cannot
 	// generate a huge surge of bogus registrations)
-	limited, err = RateLimitResponse(ctx, w, "emailreg", 10, time.Hour)
+	limited, err = RateLimitResponse(ctx, w, r, "emailreg", 10, time.Hour)
 	if err != nil || limited {
 		return
 	}
@@ -97,7 +102,7 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 	var notify []NotifyViaEmail
 	q := datastore.NewQuery("NotifyViaEmail").Filter("Address =", address.Address)
 	if _, err := q.GetAll(ctx, &notify); err != nil {
-		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
 		return
 	}
 	if len(notify) > 0 {
@@ -107,14 +112,14 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	bytes := make([]byte, 8)
 	if _, err := rand.Read(bytes); err != nil {
-		http.Error(w, "rand.Read error", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "internal_error", "rand.Read error")
 		return
 	}
 	id := hex.EncodeToString(bytes)
-	n := NotifyViaEmail{id, address.Address}
+	n := NotifyViaEmail{UserID: id, Address: address.Address}
 	k := datastore.NewIncompleteKey(ctx, "NotifyViaEmail", nil)
 	if _, err := datastore.Put(ctx, k, &n); err != nil {
-		http.Error(w, "Datastore error", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
 		return
 	}
 	sendNewID(ctx, address.Address, id)
@@ -125,16 +130,16 @@ func registerEmailHandler(w http.ResponseWriter, r *http.Request) {
 // Unregister, given userID
 func unRegisterIDHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "DELETE" {
-		http.Error(w, "unregister method must be DELETE", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "unregister method must be DELETE")
 		return
 	}
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 4 {
-		http.Error(w, "Missing userID", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
 		return
 	}
 	if len(parts) > 4 {
-		http.Error(w, "URL path too long", http.StatusBadRequest)
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
 		return
 	}
 	ctx := appengine.NewContext(r)
@@ -142,16 +147,16 @@ func unRegisterIDHandler(w http.ResponseWriter, r *http.Request) {
 	uID := parts[len(parts)-1]
 	dbKey, err := userID(ctx, uID)
 	if err != nil {
-		http.Error(w, "datastore error", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
 		return
 	}
 	if dbKey == nil {
-		http.Error(w, "User ID not found", http.StatusNotFound)
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
 		return
 	}
 	err = datastore.Delete(ctx, dbKey)
 	if err != nil {
-		http.Error(w, "Error deleting key", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Error deleting key")
 		return
 	}
 	fmt.Fprintf(w, "id %s unregistered\n", uID)
@@ -178,12 +183,50 @@ func sendNewID(ctx appengine.Context, address string, id string) {
 	}
 }
 
-func sendEmail(ctx appengine.Context, address string, tag string, b []byte, reason string) {
+// A failure to tell a user about
+type failure struct {
+	UserID    string
+	Tag       string
+	MatchTag  string // Tag of the matched entry; must be "" unless it is UserID's
+	RequestID string // See requestID
+	Bytes     []byte
+	Reason    string
+	Sources   int // For a fleet-wide collision, how many sources submitted Bytes (see fleet.go)
+}
+
+// The body of a failure email
+func failureEmailBody(ns string, f failure) string {
+	body := fmt.Sprintf("The randomsanity.org service has detected a failure.\n"+
+		"\n"+
+		"Failure reason: %s\n"+
+		"Data: 0x%s\n"+
+		"Tag: %s\n", f.Reason, hex.EncodeToString(f.Bytes), f.Tag)
+	if len(f.MatchTag) > 0 {
+		body += fmt.Sprintf("Matches earlier submission with tag: %s\n", f.MatchTag)
+	}
+	if f.Sources > 0 {
+		body += fmt.Sprintf("Submitted by %d or more different sources within %s, probably machines sharing a seed.\n"+
+			"There will be no more notifications about these bytes for that long.\n", f.Sources, fleetWindow)
+	}
+	if len(ns) > 0 {
+		body += fmt.Sprintf("Namespace: %s\n", ns)
+	}
+	if len(f.RequestID) > 0 {
+		body += fmt.Sprintf("Request ID: %s\n", f.RequestID)
+	}
+	return body
+}
+
+// Returns the delivery status, for the audit log (see audit.go)
+func sendEmail(ctx appengine.Context, address string, ns string, f failure) string {
 	// Don't spam if there are hundreds of failures, limit to
 	// a handful per day:
 	limit, err := RateLimit(ctx, address, 5, time.Hour*24)
-	if err != nil || limit {
-		return
+	if err != nil {
+		return deliveryStatus(false, err)
+	}
+	if limit {
+		return deliveryStatus(true, nil)
 	}
 
 	msg := &mail.Message{
@@ -191,21 +234,22 @@ func sendEmail(ctx appengine.Context, address string, tag string, b []byte, reas
 		To:      []string{address},
 		Subject: "Random Number Generator Failure Detected",
 	}
-	msg.Body = fmt.Sprintf("The randomsanity.org service has detected a failure.\n"+
-		"\n"+
-		"Failure reason: %s\n"+
-		"Data: 0x%s\n"+
-		"Tag: %s\n", reason, hex.EncodeToString(b), tag)
-	if err := mail.Send(ctx, msg); err != nil {
+	msg.Body = failureEmailBody(ns, f)
+	err = mail.Send(ctx, msg)
+	if err != nil {
 		log.Printf("mail.Send failed: %s", err)
 	}
+	return deliveryStatus(false, err)
 }
 
-func notify(ctx appengine.Context, uid string, tag string, b []byte, reason string) {
-	if len(uid) == 0 {
+// Email f.UserID (if registered) about f
+func notify(ctx appengine.Context, f failure) {
+	if len(f.UserID) == 0 {
 		return
 	}
-	q := datastore.NewQuery("NotifyViaEmail").Filter("UserID =", uid)
+	ns := namespace(ctx)
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
+	q := datastore.NewQuery("NotifyViaEmail").Filter("UserID =", f.UserID)
 	for t := q.Run(ctx); ; {
 		var d NotifyViaEmail
 		_, err := t.Next(&d)
@@ -216,6 +260,9 @@ func notify(ctx appengine.Context, uid string, tag string, b []byte, reason stri
 			log.Printf("Datastore error: %s", err.Error())
 			return
 		}
-		sendEmail(ctx, d.Address, tag, b, reason)
+		for _, address := range d.recipients() {
+			status := sendEmail(ctx, address, ns, f)
+			recordNotification(ctx, f, "email", status)
+		}
 	}
 }
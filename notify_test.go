@@ -0,0 +1,27 @@
+package randomsanity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailureEmailBody(t *testing.T) {
+	b := []byte{0xde, 0xad, 0xbe, 0xef}
+	body := failureEmailBody("", failure{Tag: "staging", MatchTag: "prod", RequestID: "req-1", Bytes: b, Reason: "Non Unique"})
+	for _, want := range []string{"Failure reason: Non Unique\n", "Data: 0xdeadbeef\n", "Tag: staging\n", "tag: prod\n", "Request ID: req-1\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("failureEmailBody() missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "Namespace") {
+		t.Errorf("failureEmailBody() has a namespace:\n%s", body)
+	}
+
+	body = failureEmailBody("product", failure{Tag: "staging", Bytes: b, Reason: "Counting"})
+	if strings.Contains(body, "Matches") {
+		t.Errorf("failureEmailBody() has a matched tag:\n%s", body)
+	}
+	if !strings.Contains(body, "Namespace: product\n") {
+		t.Errorf("failureEmailBody() missing namespace:\n%s", body)
+	}
+}
@@ -0,0 +1,128 @@
+package randomsanity
+
+// An organization with several services can have its registered users
+// share an "org": their submissions are checked for uniqueness against
+// each other (two of their services colliding is caught), but not
+// against anybody else's, and nobody else's against theirs.
+//
+// Each org's uniqueness database is a namespace of its own (inside the
+// client's ns=..., if any), so it has its own datastore keys and its
+// own secret for hashing them. Org IDs are random and only given to
+// users already in the org, like user IDs.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns the namespace for org's uniqueness database, within ns
+func orgNamespace(ns string, org string) string {
+	if len(org) == 0 {
+		return ns
+	}
+	if len(ns) == 0 {
+		return "org." + org
+	}
+	return ns + ".org." + org
+}
+
+// Clients can't pick an org's namespace with ns=..., or the one
+// /v1/selftest writes to
+func reservedNamespace(ns string) bool {
+	return strings.HasPrefix(ns, "org.") || strings.Contains(ns, ".org.") || ns == selfTestNamespace
+}
+
+// Returns the registration with key dbKey (for its org, and tag limits)
+func registration(ctx appengine.Context, dbKey *datastore.Key) (NotifyViaEmail, error) {
+	var n NotifyViaEmail
+	err := datastore.Get(defaultNamespace(ctx), dbKey, &n)
+	return n, err
+}
+
+// Returns a context for the uniqueness database of org (in ctx's namespace)
+func orgContext(ctx appengine.Context, org string) (appengine.Context, error) {
+	if len(org) == 0 {
+		return ctx, nil
+	}
+	return appengine.Namespace(ctx, orgNamespace(namespace(ctx), org))
+}
+
+// POST /v1/org/<id> creates a new org with user <id> in it and
+// returns the org's ID; POST /v1/org/<id>?org=<org> joins an existing
+// org; DELETE /v1/org/<id> leaves the user's org.
+func orgHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "org method must be POST or DELETE")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
+		return
+	}
+	if len(parts) > 4 {
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("org", clientIP(r, trustedProxies)), 10, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	dbKey, err := userID(ctx, parts[3])
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if dbKey == nil {
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
+		return
+	}
+
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
+	org := ""
+	if r.Method == "POST" {
+		org = r.FormValue("org")
+		if len(org) == 0 {
+			var b [8]byte
+			if _, err := rand.Read(b[:]); err != nil {
+				sendError(w, r, http.StatusInternalServerError, "internal_error", "rand.Read error")
+				return
+			}
+			org = hex.EncodeToString(b[:])
+		} else {
+			// Only existing orgs can be joined
+			keys, err := datastore.NewQuery("NotifyViaEmail").Filter("Org =", org).Limit(1).KeysOnly().GetAll(ctx, nil)
+			if err != nil {
+				sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+				return
+			}
+			if len(keys) == 0 {
+				sendError(w, r, http.StatusNotFound, "org_not_found", "Org not found")
+				return
+			}
+		}
+	}
+	var n NotifyViaEmail
+	if err := datastore.Get(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	n.Org = org
+	if _, err := datastore.Put(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	if len(org) == 0 {
+		fmt.Fprintf(w, "id %s is not in an org\n", n.UserID)
+		return
+	}
+	fmt.Fprintf(w, "org: %s\n", org)
+}
@@ -0,0 +1,45 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+func TestOrgNamespace(t *testing.T) {
+	var tests = []struct {
+		ns   string
+		org  string
+		want string
+	}{
+		{"", "", ""},
+		{"product", "", "product"},
+		{"", "0123456789abcdef", "org.0123456789abcdef"},
+		{"product", "0123456789abcdef", "product.org.0123456789abcdef"},
+	}
+	for _, test := range tests {
+		if got := orgNamespace(test.ns, test.org); got != test.want {
+			t.Errorf("orgNamespace(%q, %q) = %q, want %q", test.ns, test.org, got, test.want)
+		}
+	}
+	// Services in one org share a uniqueness database; different orgs
+	// (and users in no org) don't
+	a := orgNamespace("", "0123456789abcdef")
+	if a != orgNamespace("", "0123456789abcdef") {
+		t.Errorf("same org, different namespaces")
+	}
+	for _, other := range []string{orgNamespace("", "fedcba9876543210"), orgNamespace("", ""), orgNamespace("product", "0123456789abcdef")} {
+		if other == a {
+			t.Errorf("different orgs share namespace %q", a)
+		}
+	}
+	// ... and nobody else can get at an org's database with ns=...
+	for _, ns := range []string{a, orgNamespace("product", "0123456789abcdef"), selfTestNamespace} {
+		if !reservedNamespace(ns) {
+			t.Errorf("reservedNamespace(%q) = false", ns)
+		}
+	}
+	for _, ns := range []string{"product", "sorg.x", "organic", "selftests"} {
+		if reservedNamespace(ns) {
+			t.Errorf("reservedNamespace(%q) = true", ns)
+		}
+	}
+}
@@ -4,32 +4,110 @@ package randomsanity
 
 import (
 	"appengine"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 func init() {
 	// Main API point, sanity check hex bytes
-	http.HandleFunc("/v1/q/", submitBytesHandler)
+	handleFunc("/v1/q/", submitBytesHandler)
+	handleFunc("/v1/q", submitBytesHandler) // POST
 
 	// Start an email loop to get an id token, to be
 	// notified via email of failures:
-	http.HandleFunc("/v1/registeremail/", registerEmailHandler)
+	handleFunc("/v1/registeremail/", registerEmailHandler)
 
 	// Remove an id token
-	http.HandleFunc("/v1/unregister/", unRegisterIDHandler)
+	handleFunc("/v1/unregister/", unRegisterIDHandler)
+
+	// Share uniqueness checks with an org's other users
+	handleFunc("/v1/org/", orgHandler)
+
+	// Set the hourly quota for one of a user's tags
+	handleFunc("/v1/taglimit/", tagLimitHandler)
+
+	// Declare the distribution a user's bytes should have
+	handleFunc("/v1/distribution/", distributionHandler)
+
+	// Send a user's notifications to more addresses
+	handleFunc("/v1/contact/", contactHandler)
+
+	// Notifications sent to an id token
+	handleFunc("/v1/notifications/", notificationsHandler)
+
+	// Check several samples from one RNG for correlations
+	handleFunc("/v1/correlate", correlateHandler)
+
+	// Add to the randomness mixed into X-Entropy headers
+	handleFunc("/v1/contribute/", contributeHandler)
+	handleFunc("/v1/contribute", contributeHandler) // POST
+
+	// Check a file of values, one per line; the response is a report
+	handleFunc("/v1/batch", batchHandler)
+
+	// Statistical tests only, for samples too big for /v1/q
+	handleFunc("/v1/stream", streamHandler)
+
+	// Raw statistics, without a pass/fail verdict
+	handleFunc("/v1/measure/", measureHandler)
+	handleFunc("/v1/measure", measureHandler) // POST
+
+	// What the server decoded from a request, for clients debugging their encoding
+	handleFunc("/v1/echo/", echoHandler)
+	handleFunc("/v1/echo", echoHandler) // POST
+
+	// List the statistical tests
+	handleFunc("/v1/tests", testListHandler)
 
 	// Get usage stats
-	http.HandleFunc("/v1/usage", usageHandler)
+	handleFunc("/v1/usage", usageHandler)
+
+	// Admin-only: preload known-bad values into the uniqueness database
+	handleFunc("/v1/seed", seedHandler)
+
+	// Admin-only: view or change rate limits etc.
+	handleFunc("/v1/settings", settingsHandler)
+
+	// Admin-only: estimate the size of the uniqueness database
+	handleFunc("/v1/dbsize", dbSizeHandler)
+
+	// Admin-only: the secret for X-Service-Token headers
+	handleFunc("/v1/servicesecret", serviceSecretHandler)
+
+	// Admin-only (run by cron): forget users who unregistered
+	handleFunc("/v1/reconcile", reconcileHandler)
+
+	// Admin-only: check LooksRandom against a corpus of test vectors
+	handleFunc("/v1/replay", replayHandler)
+
+	// Admin-only: check every backend a submission uses
+	handleFunc("/v1/selftest", selfTestHandler)
+
+	// Admin-only: see a client's rate limit
+	handleFunc("/v1/ratelimit", rateLimitHandler)
+
+	// Admin-only: view or change the false-positive budget
+	handleFunc("/v1/budget", budgetHandler)
+
+	// Admin-only (run by cron, and by App Engine at shutdown): write
+	// buffered usage counts
+	handleFunc("/v1/flushusage", flushUsageHandler)
+	handleFunc("/_ah/stop", flushUsageHandler)
 
 	// Development/testing...
-	http.HandleFunc("/v1/debug", debugHandler)
+	handleFunc("/v1/debug", debugHandler)
 
 	// Redirect to www. home page
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
@@ -38,6 +116,16 @@ func init() {
 	})
 }
 
+// Registers h for pattern, after refreshing the settings (see
+// getSettings), so every handler's detectors use the current
+// false-positive budget without having to ask for it.
+func handleFunc(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		getSettings(appengine.NewContext(r))
+		h(w, r)
+	})
+}
+
 func debugHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/plain")
 
@@ -52,23 +140,202 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 	//	}
 }
 
-func submitBytesHandler(w http.ResponseWriter, r *http.Request) {
+// Largest POST body accepted, in bytes
+const maxInputBytes = 4096
+
+// Shortest /v1/q submission, enough for the statistical tests that
+// work on short inputs (see detector.minLength). The uniqueness check
+// compares 16-byte windows, so it is skipped for anything shorter
+// than minUniqueBytes.
+const (
+	minSubmissionBytes = 8
+	minUniqueBytes     = 16
+)
+
+// A problem with the bytes submitted, to send back to the client
+type inputError struct {
+	status int
+	code   string
+	msg    string
+}
+
+// Returns the bytes submitted by r, either hex in the path of a
+// GET /v1/q/<hex> (or GET /v1/q/?bytes=<hex>), or the body of a POST to /v1/q, which is raw bytes
+// if Content-Type is application/octet-stream and hex if text/plain.
+// With ?encoding=base64, the path, bytes= or text/plain body is base64
+// instead of hex. Fewer than min bytes is an error.
+func submittedBytes(r *http.Request, min int) ([]byte, *inputError) {
+	b, e := parseSubmission(r)
+	if e != nil {
+		return nil, e
+	}
+	if len(b) < min {
+		return nil, &inputError{http.StatusBadRequest, "too_short", fmt.Sprintf("Must provide %d or more bytes", min)}
+	}
+	return b, nil
+}
+
+// Like submittedBytes, but any length (see /v1/echo)
+func parseSubmission(r *http.Request) ([]byte, *inputError) {
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != "hex" && encoding != "base64" {
+		return nil, &inputError{http.StatusBadRequest, "invalid_encoding", "encoding must be hex or base64"}
+	}
 	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 4 {
-		http.Error(w, "Invalid GET", http.StatusBadRequest)
-		return
+	var b []byte
+	var err error
+	switch {
+	case r.Method == "POST" && (len(parts) == 3 || (len(parts) == 4 && parts[3] == "")):
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/octet-stream":
+			b, err = ioutil.ReadAll(io.LimitReader(r.Body, maxInputBytes+1))
+		case "text/plain":
+			var body []byte
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, 2*maxInputBytes+1))
+			if err == nil {
+				var e *inputError
+				if b, e = decodeText(strings.TrimSpace(string(body)), encoding); e != nil {
+					return nil, e
+				}
+			}
+		case "application/json":
+			// A batch, which only /v1/q and /v1/batch take (see isJSONBatch)
+			return nil, &inputError{http.StatusUnsupportedMediaType, "unsupported_media_type",
+				"POST batches to /v1/batch"}
+		default:
+			return nil, &inputError{http.StatusUnsupportedMediaType, "unsupported_media_type",
+				"Content-Type must be application/octet-stream or text/plain"}
+		}
+		if err != nil {
+			return nil, &inputError{http.StatusBadRequest, "invalid_request", "Error reading request"}
+		}
+		if len(b) > maxInputBytes {
+			return nil, &inputError{http.StatusRequestEntityTooLarge, "too_large",
+				fmt.Sprintf("Must provide %d or fewer bytes", maxInputBytes)}
+		}
+	case len(parts) == 3 || len(parts) == 4:
+		// Hex in the path, or in ?bytes= for clients whose proxies
+		// mangle long paths. The path wins if there are both.
+		h := ""
+		if len(parts) == 4 {
+			h = parts[3]
+		}
+		if len(h) == 0 {
+			h = r.URL.Query().Get("bytes")
+		}
+		var e *inputError
+		if b, e = decodeText(h, encoding); e != nil {
+			return nil, e
+		}
+	default:
+		return nil, &inputError{http.StatusBadRequest, "invalid_request", "Invalid GET"}
+	}
+	return b, nil
+}
+
+// Decodes s as hex, or as base64 (standard or URL-safe alphabet,
+// padding optional) if encoding is "base64"
+func decodeText(s string, encoding string) ([]byte, *inputError) {
+	if encoding != "base64" {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, &inputError{http.StatusBadRequest, "invalid_hex", "Invalid hex"}
+		}
+		return b, nil
+	}
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(s)
 	}
-	b, err := hex.DecodeString(parts[len(parts)-1])
 	if err != nil {
-		http.Error(w, "Invalid hex", http.StatusBadRequest)
+		return nil, &inputError{http.StatusBadRequest, "invalid_base64", "Invalid base64"}
+	}
+	return b, nil
+}
+
+// Clients checking values that aren't a whole number of bytes (a
+// 130-bit key, say) pass bits=N: the value is the first N bits of the
+// bytes submitted, most significant bit first, and the rest of the
+// last byte is padding. Returns b with the padding bits cleared (so
+// whatever the client padded with doesn't affect uniqueness), and just
+// the whole bytes of the value, for the statistical tests.
+func bitSlice(b []byte, bits string) ([]byte, []byte, *inputError) {
+	if len(bits) == 0 {
+		return b, b, nil
+	}
+	n, err := strconv.Atoi(bits)
+	if err != nil || n <= 8*(len(b)-1) || n > 8*len(b) {
+		return nil, nil, &inputError{http.StatusBadRequest, "invalid_bits",
+			fmt.Sprintf("bits must be between %d and %d", 8*(len(b)-1)+1, 8*len(b))}
+	}
+	if n < 8*minSubmissionBytes {
+		return nil, nil, &inputError{http.StatusBadRequest, "too_short",
+			fmt.Sprintf("Must provide %d or more bits", 8*minSubmissionBytes)}
+	}
+	masked := append([]byte(nil), b...)
+	if n%8 != 0 {
+		masked[len(b)-1] &= 0xff << uint(8-n%8)
+	}
+	return masked, masked[:n/8], nil
+}
+
+// Longest client-supplied request ID that is echoed back
+const maxRequestIDLength = 64
+
+// Returns the client's X-Request-ID header (or rid=... parameter), so
+// they can match our response (and any notification) to their logs;
+// if they didn't send a usable one, makes one up.
+func requestID(r *http.Request) string {
+	rid := r.Header.Get("X-Request-ID")
+	if len(rid) == 0 {
+		rid = r.URL.Query().Get("rid")
+	}
+	valid := len(rid) > 0 && len(rid) <= maxRequestIDLength
+	for i := 0; i < len(rid) && valid; i++ {
+		// Printable ASCII only, it goes in headers and emails
+		valid = rid[i] > ' ' && rid[i] <= '~'
+	}
+	if valid {
+		return rid
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func submitBytesHandler(w http.ResponseWriter, r *http.Request) {
+	rid := requestID(r)
+	w.Header().Set("X-Request-ID", rid)
+
+	// A JSON array of values is a batch
+	if isJSONBatch(r) {
+		batchHandler(w, r)
 		return
 	}
-	// Need at least 16 bytes to hit the 1-in-2^60 false positive rate
-	if len(b) < 16 {
-		http.Error(w, "Must provide 16 or more bytes", http.StatusBadRequest)
+
+	b, e := submittedBytes(r, minSubmissionBytes)
+	if e != nil {
+		recordRejection(r, e.code)
+		sendError(w, r, e.status, e.code, e.msg)
+		return
+	}
+	b, wholeBytes, e := bitSlice(b, r.FormValue("bits"))
+	if e != nil {
+		recordRejection(r, e.code)
+		sendError(w, r, e.status, e.code, e.msg)
 		return
 	}
 
+	w.Header().Set("X-Analyses", analyses(len(b)))
+
+	// Clients can pass expect=N, the number of bytes they asked their
+	// RNG for, to catch short reads: the response gets an X-Warning
+	// header if a different number of bytes was submitted (and see
+	// shortRead).
+	expect, _ := strconv.Atoi(r.FormValue("expect"))
+
 	ctx := appengine.NewContext(r)
 
 	// Users that register can append id=....&tag=.... so
@@ -81,22 +348,37 @@ func submitBytesHandler(w http.ResponseWriter, r *http.Request) {
 		uID = ""
 	} else {
 		tag = r.FormValue("tag")
-		if len(tag) > 64 {
-			tag = "" // Tags must be short
+		if len(tag) > 64 || tag == seedTag {
+			tag = "" // Tags must be short, and can't pass for a seeded value
+		}
+	}
+	var reg NotifyViaEmail
+	if dbKey != nil {
+		var err error
+		if reg, err = registration(ctx, dbKey); err != nil {
+			sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+			return
 		}
 	}
 
-	// Rate-limit by IP address, with a much higher limit for registered users
-	// If more complicated logic is needed because of abuse a per-user limit
-	// could be stored in the datastore, but running into the 600-per-hour-per-ip
-	// limit should be rare (maybe a sysadmin has 200 virtual machines
-	// behind the same IP address and restarts them more than three times in a hour....)
-	var ratelimit uint64 = 60
-	if len(uID) > 0 {
-		ratelimit = 600
+	// Rate-limit by IP address, with a much higher limit for registered users,
+	// who are also limited per user and per tag (see submissionLimits). Running
+	// into the per-hour-per-ip limit (Settings.RateLimit) should be rare (maybe a
+	// sysadmin has 200 virtual machines behind the same IP address and restarts
+	// them several times in a hour....)
+	settings := getSettings(ctx)
+	ip := clientIP(r, trustedProxies)
+	for _, l := range submissionLimits(ip, uID, tag, settings, reg.TagRateLimits) {
+		limited, err := RateLimitResponse(ctx, w, r, l.key, l.max, time.Hour)
+		if err != nil || limited {
+			return
+		}
 	}
-	limited, err := RateLimitResponse(ctx, w, IPKey("q", r.RemoteAddr), ratelimit, time.Hour)
-	if err != nil || limited {
+
+	// Everything else is scoped to the client's namespace (if any)
+	nsCtx, err := namespaceContext(ctx, r)
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_namespace", "Invalid namespace")
 		return
 	}
 
@@ -104,14 +386,68 @@ func submitBytesHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Returns some randomness caller can use to mix in to
 	// their PRNG:
-	addEntropyHeader(w)
+	entropy := memcacheEntropy{ctx}
+	addEntropyHeader(entropy, w)
+
+	// score=1 adds an X-Score header, for clients that want to pick
+	// their own threshold (see Score, and ScoreAgainst for registered
+	// users that declared a distribution)
+	if r.FormValue("score") == "1" {
+		w.Header().Set("X-Score", strconv.FormatFloat(ScoreAgainst(wholeBytes, reg.Distribution), 'f', 3, 64))
+	}
+
+	recent := recentKey(namespace(nsCtx), ip, b)
+	if verdict, ok := recentVerdict(ctx, recent); ok {
+		RecordUsage(nsCtx, "Repeat", 1)
+		w.Header().Add("X-Warning", "Same bytes already submitted from this address")
+		sendResult(w, verdict)
+		return
+	}
+
+	flagged := ""
+	if len(uID) > 0 {
+		flagged = flaggedKey(namespace(nsCtx), uID, b)
+		if f, ok := previouslyFlagged(ctx, flagged); ok {
+			RecordUsage(nsCtx, "Reflagged", 1)
+			w.Header().Add("X-Warning", flaggedWarning(f))
+			sendResult(w, f.Result)
+			return
+		}
+	}
+
+	if expect > 0 && expect != len(b) {
+		w.Header().Add("X-Warning", fmt.Sprintf("Expected %d bytes, got %d", expect, len(b)))
+	}
+	for _, warning := range Warnings(wholeBytes) {
+		w.Header().Add("X-Warning", warning)
+	}
 
 	// First, some simple tests for non-random input:
-	result, reason := LooksRandom(b)
+	result, reason := checkSubmission(r, b, wholeBytes, expect, reg.Distribution, func(b []byte) bool { return issuedEntropy(entropy, b) })
 	if !result {
-		RecordUsage(ctx, "Fail_"+reason, 1)
-		fmt.Fprint(w, "false")
-		notify(ctx, uID, tag, b, reason)
+		RecordUsage(nsCtx, "Fail_"+reason, 1)
+		logVerdict(ctx, r, resultNotRandom, reason, len(b), uID, tag)
+		sendResult(w, resultNotRandom)
+		rememberVerdict(ctx, recent, resultNotRandom)
+		if len(flagged) > 0 {
+			rememberFlagged(ctx, flagged, flaggedSubmission{resultNotRandom, reason, time.Now().Unix()})
+		}
+		notify(nsCtx, failure{UserID: uID, Tag: tag, RequestID: rid, Bytes: b, Reason: reason})
+		return
+	}
+	// Keep track of which tests are doing work:
+	for _, p := range Passed(wholeBytes) {
+		RecordUsage(nsCtx, "Pass_"+p, 1)
+	}
+	clockClusters(nsCtx, r, b, uID, tag)
+
+	// Too short for the uniqueness check; the statistical tests
+	// were all that applied (see analyses)
+	if len(b) < minUniqueBytes {
+		RecordUsage(nsCtx, "Success", 1)
+		RecordUsage(nsCtx, "Short", 1)
+		logVerdict(ctx, r, resultRandom, "", len(b), uID, tag)
+		sendResult(w, resultRandom)
 		return
 	}
 
@@ -120,15 +456,132 @@ func submitBytesHandler(w http.ResponseWriter, r *http.Request) {
 	if len(b) > 64 {
 		b = b[0:64] // Prevent DoS from excessive datastore lookups
 	}
-	unique, err := looksUnique(ctx, w, b, uID, tag)
-	if err != nil {
+	// Registered users in an org are only checked against each other
+	uniqueCtx := nsCtx
+	if dbKey != nil {
+		uniqueCtx, err = orgContext(nsCtx, reg.Org)
+		if err != nil {
+			sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+			return
+		}
+	}
+	unique, err := looksUnique(uniqueCtx, w, r, b, uID, tag, rid, settings)
+	if err == errTooManyWindows {
 		return
 	}
-	if unique {
-		RecordUsage(ctx, "Success", 1)
-		fmt.Fprint(w, "true")
+	if err != nil {
+		RecordUsage(nsCtx, "UniqueIndeterminate", 1)
+	}
+	if uniqueVerdict(w, unique, err) == resultRandom {
+		RecordUsage(nsCtx, "Success", 1)
+		logVerdict(ctx, r, resultRandom, "", len(b), uID, tag)
+		sendResult(w, resultRandom)
 	} else {
-		RecordUsage(ctx, "Fail_Nonunique", 1)
-		fmt.Fprint(w, "false")
+		RecordUsage(nsCtx, "Fail_Nonunique", 1)
+		logVerdict(ctx, r, resultNotUnique, "Nonunique", len(b), uID, tag)
+		sendResult(w, resultNotUnique)
+		rememberVerdict(ctx, recent, resultNotUnique)
+		if len(flagged) > 0 {
+			rememberFlagged(ctx, flagged, flaggedSubmission{resultNotUnique, "Non Unique", time.Now().Unix()})
+		}
+	}
+}
+
+// Which checks a /v1/q submission of n bytes gets, for the
+// X-Analyses header: uniqueness needs minUniqueBytes. (X-Uniqueness
+// says if it was skipped anyway.)
+func analyses(n int) string {
+	if n < minUniqueBytes {
+		return "statistical"
+	}
+	return "statistical, uniqueness"
+}
+
+// The statistical tests (against d, the distribution a registered
+// submitter declared; see LooksRandomAgainst), plus the ones that
+// depend on what else the client told us (see submitBytesHandler);
+// issued says whether bytes are an X-Entropy value we handed out, and
+// expect is the client's expect= (0 if none). masked is the whole
+// submission with any bits= padding cleared, and wholeBytes just its
+// whole bytes (the partial last byte dropped), as bitSlice returns
+// them.
+func checkSubmission(r *http.Request, masked []byte, wholeBytes []byte, expect int, d Distribution, issued func([]byte) bool) (bool, string) {
+	if ok, reason := LooksRandomAgainst(wholeBytes, d); !ok {
+		return false, reason
+	}
+	if shortRead(masked, expect) {
+		return false, "Short read"
+	}
+	// Clients submitting a list of nonces can say how long each is
+	if size, err := strconv.Atoi(r.FormValue("nonce_size")); err == nil && RepeatedNonce(wholeBytes, size) {
+		return false, "Repeated nonce"
+	}
+	// Feeding our own X-Entropy back to us doesn't test anything:
+	if issued(masked) {
+		return false, "Server-provided entropy, not your RNG"
+	}
+	return true, ""
+}
+
+// Returns true if b, which the client says should be expect random
+// bytes, ends in the zeros a short read into a zero-filled buffer
+// leaves: every byte past expect, or (for a buffer of the expected
+// length, or nearly) at least its last 8.
+func shortRead(b []byte, expect int) bool {
+	if expect <= 0 || expect > len(b) {
+		return false
+	}
+	n := len(b) - expect
+	if 8*n < fpBits() {
+		n = ceilDiv(fpBits(), 8)
+	}
+	return ConstantPadding(b, n)
+}
+
+// Failed submissions are logged as key="value" pairs so they can be
+// searched for in the logs; successful ones aren't logged at all. Set
+// failureLogLevel to "" to stop logging them, or change
+// failureLogFields to log less.
+// The submitted bytes are never logged.
+const failureLogLevel = "info"
+
+var failureLogFields = []string{"reason", "length", "registered", "tagged", "ip"}
+
+// The part of appengine.Context logVerdict uses
+type logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+}
+
+// Logs a submission's result (see sendResult), if it failed
+func logVerdict(l logger, r *http.Request, result string, reason string, n int, uID string, tag string) {
+	if result == resultRandom {
+		return
+	}
+	line := failureLogLine(map[string]string{
+		"reason":     reason,
+		"length":     strconv.Itoa(n),
+		"registered": strconv.FormatBool(len(uID) > 0),
+		"tagged":     strconv.FormatBool(len(tag) > 0),
+		"ip":         clientIP(r, trustedProxies),
+	})
+	switch failureLogLevel {
+	case "debug":
+		l.Debugf("%s", line)
+	case "info":
+		l.Infof("%s", line)
+	case "warning":
+		l.Warningf("%s", line)
+	}
+}
+
+func failureLogLine(values map[string]string) string {
+	parts := []string{"Submission failed"}
+	for _, k := range failureLogFields {
+		if v, ok := values[k]; ok {
+			parts = append(parts, k+"="+strconv.Quote(v))
+		}
 	}
+	return strings.Join(parts, " ")
 }
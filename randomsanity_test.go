@@ -0,0 +1,277 @@
+package randomsanity
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFailureLogLine(t *testing.T) {
+	got := failureLogLine(map[string]string{
+		"reason":     "Repeated bytes",
+		"length":     "32",
+		"registered": "true",
+		"tagged":     "false",
+		"ip":         "10.0.0.1",
+		"bytes":      "deadbeef", // Not a logged field
+	})
+	want := `Submission failed reason="Repeated bytes" length="32" registered="true" tagged="false" ip="10.0.0.1"`
+	if got != want {
+		t.Errorf("failureLogLine() = %s, want %s", got, want)
+	}
+}
+
+func TestCheckSubmission(t *testing.T) {
+	random, _ := hex.DecodeString("13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a")
+	// A 32-byte buffer that only got 24 random bytes
+	short := append(append([]byte{}, random[:24]...), make([]byte, 8)...)
+	never := func([]byte) bool { return false }
+	var tests = []struct {
+		expect int
+		b      []byte
+		issued func([]byte) bool
+		want   string // Failure reason, "" to pass
+	}{
+		{0, random, never, ""},
+		{32, random, never, ""},
+		{32, short, never, "Repeated bytes"}, // Statistical tests first
+		{40, short, never, "Repeated bytes"},
+		{16, random, never, ""},
+		{0, random[:24], func([]byte) bool { return true }, "Server-provided entropy, not your RNG"},
+		{32, make([]byte, 33), never, "Constant fill"}, // Statistical tests first
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/q/"+hex.EncodeToString(test.b), nil)
+		ok, reason := checkSubmission(r, test.b, test.b, test.expect, nil, test.issued)
+		if ok != (test.want == "") || reason != test.want {
+			t.Errorf("checkSubmission(%x, expect=%d) = %v, %q, want %q", test.b, test.expect, ok, reason, test.want)
+		}
+	}
+	// With bits=255, the statistical tests don't see the partial last
+	// byte, so only shortRead sees 8 zeros
+	for _, test := range []struct {
+		expect int
+		want   string
+	}{
+		{32, "Short read"},
+		{24, "Short read"},
+		{0, ""},
+		{40, ""}, // Too few bytes is just a warning
+	} {
+		r := httptest.NewRequest("GET", "/v1/q/"+hex.EncodeToString(short)+"?bits=255", nil)
+		ok, reason := checkSubmission(r, short, short[:31], test.expect, nil, never)
+		if ok != (test.want == "") || reason != test.want {
+			t.Errorf("checkSubmission(%x, bits=255, expect=%d) = %v, %q, want %q", short, test.expect, ok, reason, test.want)
+		}
+	}
+}
+
+// A logger that keeps what's logged
+type capturedLog []string
+
+func (c *capturedLog) Debugf(format string, args ...interface{}) {
+	*c = append(*c, "DEBUG "+fmt.Sprintf(format, args...))
+}
+func (c *capturedLog) Infof(format string, args ...interface{}) {
+	*c = append(*c, "INFO "+fmt.Sprintf(format, args...))
+}
+func (c *capturedLog) Warningf(format string, args ...interface{}) {
+	*c = append(*c, "WARNING "+fmt.Sprintf(format, args...))
+}
+
+func TestLogVerdict(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/q/00", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	var tests = []struct {
+		result string
+		reason string
+		want   string // "" for no line
+	}{
+		{resultNotRandom, "Counting", `INFO Submission failed reason="Counting" length="32" registered="true" tagged="false" ip="10.0.0.1"`},
+		{resultNotUnique, "Nonunique", `INFO Submission failed reason="Nonunique" length="32" registered="true" tagged="false" ip="10.0.0.1"`},
+		{resultRandom, "", ""},
+	}
+	for _, test := range tests {
+		var c capturedLog
+		logVerdict(&c, r, test.result, test.reason, 32, "0123456789abcdef", "")
+		if len(test.want) == 0 {
+			if len(c) != 0 {
+				t.Errorf("logVerdict(%s) logged %q", test.result, c)
+			}
+			continue
+		}
+		if len(c) != 1 || c[0] != test.want {
+			t.Errorf("logVerdict(%s) logged %q, want %q", test.result, c, test.want)
+		}
+	}
+}
+
+func TestSubmittedBytes(t *testing.T) {
+	hex16 := "0f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	raw16, _ := hex.DecodeString(hex16)
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        []byte
+		status      int
+	}{
+		{"GET", "/v1/q/" + hex16, "", "", raw16, 0},
+		{"GET", "/v1/q/zz", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/00ff", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/" + hex16[:16], "", "", raw16[:8], 0}, // Statistical tests only
+		{"GET", "/v1/q/" + hex16[:14], "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/a/b", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/?bytes=" + hex16, "", "", raw16, 0},
+		{"GET", "/v1/q?bytes=" + hex16, "", "", raw16, 0},
+		{"GET", "/v1/q/?bytes=zz", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/?bytes=00ff", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/" + hex16 + "?bytes=zz", "", "", raw16, 0}, // Path wins
+		{"GET", "/v1/q/?bytes=Dx4tPEtaaXiHlqW0w9Lh8A==&encoding=base64", "", "", raw16, 0},
+		{"GET", "/v1/q/?bytes=Dx4t&encoding=base64", "", "", nil, http.StatusBadRequest},
+		{"GET", "/v1/q/", "", "", nil, http.StatusBadRequest},
+		{"POST", "/v1/q", "application/octet-stream", string(raw16), raw16, 0},
+		{"POST", "/v1/q/", "application/octet-stream", string(raw16), raw16, 0},
+		{"POST", "/v1/q", "text/plain; charset=utf-8", hex16 + "\n", raw16, 0},
+		{"POST", "/v1/q", "text/plain", "not hex", nil, http.StatusBadRequest},
+		{"POST", "/v1/q", "application/octet-stream", strings.Repeat("x", maxInputBytes+1), nil, http.StatusRequestEntityTooLarge},
+		{"POST", "/v1/q", "application/json", `["` + hex16 + `"]`, nil, http.StatusUnsupportedMediaType},
+		{"POST", "/v1/q", "image/png", string(raw16), nil, http.StatusUnsupportedMediaType},
+		{"POST", "/v1/q", "", string(raw16), nil, http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		b, e := submittedBytes(r, minSubmissionBytes)
+		switch {
+		case test.status != 0 && (e == nil || e.status != test.status):
+			t.Errorf("%s %s (%s): got %v, want status %d", test.method, test.path, test.contentType, e, test.status)
+		case test.status == 0 && (e != nil || !bytes.Equal(b, test.want)):
+			t.Errorf("%s %s (%s): got %x %v, want %x", test.method, test.path, test.contentType, b, e, test.want)
+		}
+	}
+}
+
+func TestBitSlice(t *testing.T) {
+	b17, _ := hex.DecodeString("0f1e2d3c4b5a69788796a5b4c3d2e1f0ff")
+	var tests = []struct {
+		bits   string
+		masked string // hex
+		whole  int
+		status int
+	}{
+		{"", "0f1e2d3c4b5a69788796a5b4c3d2e1f0ff", 17, 0},
+		{"136", "0f1e2d3c4b5a69788796a5b4c3d2e1f0ff", 17, 0},
+		{"130", "0f1e2d3c4b5a69788796a5b4c3d2e1f0c0", 16, 0},
+		{"129", "0f1e2d3c4b5a69788796a5b4c3d2e1f080", 16, 0},
+		{"135", "0f1e2d3c4b5a69788796a5b4c3d2e1f0fe", 16, 0},
+		{"128", "", 0, http.StatusBadRequest}, // That's 16 bytes, not 17
+		{"137", "", 0, http.StatusBadRequest},
+		{"x", "", 0, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		masked, whole, e := bitSlice(b17, test.bits)
+		switch {
+		case test.status != 0 && (e == nil || e.status != test.status):
+			t.Errorf("bitSlice(bits=%q): got %v, want status %d", test.bits, e, test.status)
+		case test.status == 0 && (e != nil || hex.EncodeToString(masked) != test.masked || len(whole) != test.whole):
+			t.Errorf("bitSlice(bits=%q) = %x, %d bytes, %v; want %s, %d bytes", test.bits, masked, len(whole), e, test.masked, test.whole)
+		}
+	}
+	// Padding bits don't matter:
+	other := append([]byte(nil), b17...)
+	other[16] = 0xc5
+	m1, _, _ := bitSlice(b17, "130")
+	m2, _, _ := bitSlice(other, "130")
+	if !bytes.Equal(m1, m2) {
+		t.Errorf("bitSlice ignoring padding: %x != %x", m1, m2)
+	}
+	// ... and b17 isn't changed:
+	if b17[16] != 0xff {
+		t.Errorf("bitSlice changed its input")
+	}
+	// Too few bits for the statistical tests
+	if _, _, e := bitSlice(b17[:8], "63"); e == nil || e.code != "too_short" {
+		t.Errorf("bitSlice(8 bytes, bits=63) = %v, want too_short", e)
+	}
+}
+
+// 8 to 15 bytes get the statistical tests that work on short inputs,
+// but no uniqueness check
+func TestShortSubmission(t *testing.T) {
+	random, _ := hex.DecodeString("13edbd95b51624cbaa36ed7b")
+	never := func([]byte) bool { return false }
+	var tests = []struct {
+		b    []byte
+		want string // Failure reason, "" to pass
+	}{
+		{random[:8], ""},
+		{random, ""},
+		{make([]byte, 8), "Repeated bytes"},
+		{[]byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}, "Counting"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/q/"+hex.EncodeToString(test.b), nil)
+		b, e := submittedBytes(r, minSubmissionBytes)
+		if e != nil {
+			t.Fatalf("submittedBytes(%x) = %v", test.b, e)
+		}
+		ok, reason := checkSubmission(r, b, b, 0, nil, never)
+		if ok != (test.want == "") || reason != test.want {
+			t.Errorf("checkSubmission(%x) = %v, %q, want %q", test.b, ok, reason, test.want)
+		}
+		if a := analyses(len(b)); a != "statistical" {
+			t.Errorf("analyses(%d) = %q", len(b), a)
+		}
+	}
+	if a := analyses(minUniqueBytes); a != "statistical, uniqueness" {
+		t.Errorf("analyses(%d) = %q", minUniqueBytes, a)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var tests = []struct {
+		header string
+		path   string
+		want   string // "" for a generated one
+	}{
+		{"abc-123", "/v1/q/00", "abc-123"},
+		{"", "/v1/q/00?rid=pipeline.42", "pipeline.42"},
+		{"from-header", "/v1/q/00?rid=from-param", "from-header"},
+		{"", "/v1/q/00", ""},
+		{"has space", "/v1/q/00", ""},
+		{strings.Repeat("x", maxRequestIDLength+1), "/v1/q/00", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			r.Header.Set("X-Request-ID", test.header)
+		}
+		got := requestID(r)
+		switch {
+		case test.want != "" && got != test.want:
+			t.Errorf("requestID(%q, %s) = %q, want %q", test.header, test.path, got, test.want)
+		case test.want == "" && (len(got) != 16 || got == test.header):
+			t.Errorf("requestID(%q, %s) = %q, want a generated ID", test.header, test.path, got)
+		}
+	}
+	r := httptest.NewRequest("GET", "/v1/q/00", nil)
+	if requestID(r) == requestID(r) {
+		t.Error("requestID generated the same ID twice")
+	}
+
+	// Echoed even on errors
+	r.Header.Set("X-Request-ID", "abc-123")
+	w := httptest.NewRecorder()
+	submitBytesHandler(w, r)
+	if got := w.Header().Get("X-Request-ID"); got != "abc-123" {
+		t.Errorf("X-Request-ID = %q", got)
+	}
+}
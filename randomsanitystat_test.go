@@ -1,8 +1,14 @@
 package randomsanity
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"math"
+	mathrand "math/rand"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -41,6 +47,127 @@ func TestLooksRandom(t *testing.T) {
 		{"0100000000000000 0200000000000000", false}, // little-endian
 		{"ff4132e53728dc4e 004232e53728dc4e", false},
 
+		// Binary-coded-decimal counters
+		// (rngstat.BCDCounting tests)
+		{"08 09 10 11 12 13 14 15 16", false},
+		{"08 09 10 11 12 13 14 15", true},
+		{"0998 0999 1000 1001 1002", false},
+		{"00009999 00010000 00010001", false},
+		{"98 99 00 01 02 03 04 05 06", true}, // Counter wraps around; 8 bytes isn't enough
+
+		// Each number the sum of the two before it
+		// (rngstat.Fibonacci tests)
+		{"01 01 02 03 05 08 0d 15 22 37", false},
+		{"a7 3c e3 1f 02 21 23 44 67 ab", false},
+		{"a7 3c e3 1f 02 21 23 44 67", true},     // Too short
+		{"9d41 27c3 c504 ecc7 b1cb 9e92", false}, // big-endian
+		{"419d c327 04c5 c7ec cbb1 929e", false}, // little-endian
+		{"9d41 27c3 c504 ecc7 b1cb", true},
+		{"6b8b4567 327b23c6 9e06692d d0818cf3", false},
+		{"67458b6b c6237b32 2d69069e f38c81d0", false},
+		{"6b8b4567 327b23c6 9e06692d d0818cf4", true},
+
+		// Two or four counters interleaved byte-by-byte
+		// (rngstat.Interleaved tests)
+		{"10a0 11a1 12a2 13a3 14a4 15a5 16a6 17a7 18a8", false},
+		{"1013 1114 1215 1316 1417 1518 1619 171a", true}, // 8 per lane is too short
+		{"00 35 f0 9a 01 36 f1 9b 02 37 f2 9c 03 38 f3 9d 04 39 f4 9e 05 3a f5 9f 06 3b f6 a0 07 3c f7 a1 08 3d f8 a2", false},
+		{"81a6 82a7 83a8 84a9 85aa 86ab 87ac 88ad 89ae", false},
+		{"8185 8286 8387 8488 8589 868a 878b 888c 898e", true}, // One lane isn't counting
+
+		// Random blocks with a counter field in each one
+		// (rngstat.BlockCounter tests)
+		// 8-byte blocks, 1-byte counter at offset 3; need 10 blocks
+		{"38b4e641e44da7f2370d9e420e27136550a4a343d07f5c0c332f8b4424083fd22b902f4511e81818f8c99d465d9831957504d947945de2e8f54ee748cc75f636d85099495aa300165a67034a9b540d6b", false},
+		{"8f0be24124179c3dd9f73842ce6e118d264aad43b6dd210faf94ac44cf92c190237cb1455d108cf25930264638b370a1b5769f47f1483f95a90d9d48f130d60fcf04bd49f50ae695", true},
+		// 16-byte blocks, little-endian 4-byte counter at offset 4
+		{"14da8c65f00f3e9cccdaebf990d19838b0d7ec0bf10f3e9ccb96c4dbadbe172296d5234af20f3e9ca4e6ed24ec636a8ac0a1271ef30f3e9c38aaf84e58056d8f", false},
+
+		// Keyboard mashing
+		// (rngstat.HexSequence and rngstat.RepeatedWord tests)
+		{"0123456789abcdef0123456789abcdef", false},
+		{"fedcba9876543210fedcba9876543210", false},
+		{"e47d253e 0123456789abcdef0120 45ccfa65f4449367", false},
+		{"e47d253e 0123456789abcdef01f0 45ccfa65f4449367", true}, // 18 digits isn't enough
+		{"deadbeefdeadbeefdeadbeefdeadbeef", false},
+		{"cafebabecafebabecafebabecafebabe", false},
+		{"e47d253e a1b2a1b2a1b2a1b2a1b2a1b2 45ccfa65", false},
+		{"e47d253e a1b2a1b2a1b2a1b2a1b2a1 45ccfa65", true}, // 9 repeated bytes isn't enough
+		{"e47d253e 0102030405 0102030405 0102030405 a1b2c3d4", false},
+
+		// Half a buffer copied over the other half
+		// (rngstat.DuplicatedHalves tests)
+		{"e47d253e45ccfa65 e47d253e45ccfa65", false},
+		{"13edbd95b51624cbaa36ed7bc011b152 13edbd95b51624cbaa36ed7bc011b152", false},
+		{"13edbd95b51624cbaa36ed7bc011b152 3d453bf09f4b7c6db9480790d61b5e0a", true},
+		{"13edbd95b51624cbaa36ed7bc011b152 13edbd95b51624cb3c36ed7bc011b152", true},
+
+		// Nonces made of a fixed prefix and a counter
+		// (rngstat.NonceCounter tests)
+		{"9f3a61c2e07b55d10001ffff 9f3a61c2e07b55d100020000 9f3a61c2e07b55d100020001", false},
+		{"5be2a7c409d1e36f2900000000000000 5be2a7c409d1e36f2a00000000000000", false},         // little-endian
+		{"9f3a61c200000200 9f3a61c201000200", true},                                          // 2 8-byte blocks isn't enough
+		{"9f3a61c2e07b55d10001ffff 9f3a61c2e07b55d100020000 9f3a61c2e07b55d200020001", true}, // Prefix changes
+		{"9f3a61c2e07b55d10001ffff 9f3a61c2e07b55d100020000 9f3a61c2e07b55d100020002", true}, // Counter skips
+
+		// A counter, hex-encoded and then submitted as text
+		// (rngstat.HexTextCounting tests)
+		{"303030303030303130303030303030323030303030303033", false}, // "000000010000000200000003"
+		{"303030392030303130203030313120303031322030303133", false}, // "0009 0010 0011 0012 0013"
+		{"306130623063306430653066313031313132", false},             // "0a0b0c0d0e0f101112"
+		{"304130423043304430453046313031313132", false},             // "0A0B0C0D0E0F101112"
+		{"306130623063306430653066313031313133", true},              // "0a0b0c0d0e0f101113"
+
+		// Counters with a random low byte
+		// (rngstat.JitteredCounter tests)
+		{"379f 3832 398e 3af1 3b0a 3c0a 3db9 3ee6 3f5e 4036", false},
+		{"8c913c5a 45923c5a 09933c5a 7e943c5a", false},         // little-endian
+		{"379f 3832 398e 3af1 3b0a 3c0a 3db9 3ee6 3f5e", true}, // 9 is too few
+		{"8c913c5a 45923c5a 09933c5a 7e953c5a", true},          // Counter skips
+
+		// Shuffled tables of consecutive values
+		// (rngstat.Permutation tests)
+		{"8184797f7d78857c7a877e828086837b", false},
+		{"414346443e3b45474840423c3d3f", false},
+		{"414346443e3b45474840423c3d41", true}, // 41 twice
+		{"414346443e3b45474840423c3d49", true}, // 3f missing
+
+		// A block copied to later in the buffer
+		// (rngstat.DuplicateBlocks tests)
+		{"9dc8493bf491b664 d17df7563e4a99ca 3cfb8eaf909d18af 9dc8493bf491b664 d17df7563e4a99ca", false},
+		{"9dc8493bf491b664 d17df7563e4a99ca 9dc8493bf491b664 3cfb8eaf909d18af 9dc8493bf491b664", false},
+		{"9dc8493bf491b664 d17df7563e4a99ca 3cfb8eaf909d18af 9dc8493bf491b664", true},                    // Once could be chance
+		{"9dc8493bf491b664 d17df7563e4a99ca 3cfb8eaf909d18af 009dc8493bf491b6 64d17df7563e4a99ca", true}, // Not aligned
+
+		// Words written in both byte orders
+		// (rngstat.ByteSwapped tests)
+		{"1a2b3c4d 4d3c2b1a 1a2b3c4d 4d3c2b1a", false},
+		{"e47d253e 3e257de4 45ccfa65 65facc45", false},
+		{"e47d 7de4 253e 3e25 45cc cc45 fa65 65fa", false},
+		{"e47d253e45ccfa65 65facc453e257de4", false},
+		{"e47d253e 3e257de4 45ccfa65", true},          // Only one 32-bit pair
+		{"e47d253e 3e257de4 45ccfa65 65facc44", true}, // Second pair isn't swapped
+
+		// Device identifiers used as random bytes
+		// (rngstat.SequentialMACs and rngstat.SequentialIPv4 tests)
+		{"3c5ab4010203 3c5ab4010204 3c5ab4010205 3c5ab4010206", false},
+		{"0050569a13f0 0050569a1401 0050569a1422 0050569a14f5", false},   // Increasing, with gaps
+		{"0050569a13f0 0050569a1401 0050569a1422", true},                 // 3 is too few
+		{"0050569a13f0 0050569a1401 0050569a1422 0051569a14f5", true},    // Different OUI
+		{"0050569a13f0 0050569a1401 0050569a1422 0050569a1422", true},    // Not increasing
+		{"0050569a13f0 0050569a1401 0050569a1422 0050569a14f5 00", true}, // Not whole addresses
+		{"c0a80105 c0a80109 c0a80132 c0a801fe", false},
+		{"c0a80105 c0a80109 c0a80132 c0a802fe", true},
+		{"8b2c9e4f1d6a 73e0b5a2c48f 19d7f3064be2 a45c08e17f3b", true},
+
+		// Each block the SHA-256 of the one before
+		// (rngstat.HashChain tests)
+		{"e47d253e45ccfa65f44493677aaf56ae 35dd92f91799b48fb5a69c16916f088a 33a0815685a484d5f898c88de6e60b23 10f3cb0b63549ed4bd9cf05721fabf49", false},
+		{"e47d253e45ccfa65f44493677aaf56ae 35dd92f91799b48fb5a69c16916f088a", false},
+		{"e47d253e45ccfa65f44493677aaf56ae 35dd92f91799b48fb5a69c16916f088a 33a0815685a484d5f898c88de6e60b24", true}, // Broken link
+		{"13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a 460427c381e962604162df74931fc77a2cad9136337c820139d94cf38da80b6f", false},
+		{"13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a 460427c381e962604162df74931fc77b2cad9136337c820139d94cf38da80b6f", true},
+
 		// repeated bytes tests
 		// (rngstat.Repeated tests)
 		{"00", true},
@@ -58,6 +185,13 @@ func TestLooksRandom(t *testing.T) {
 		{"39393939393939ab", true},
 		{"3939393939393939", false},
 		{"ff393939393939393939bb", false},
+		// Runs don't wrap around from the end to the start:
+		{"0000000000 e47d253e45ccfa65 000000", true},
+		{"00000000 e47d253e45ccfa65 00000000", true},
+		{"000000000000 e47d253e45ccfa65 0000000000", true},
+		{"00000000000000 e47d253e45ccfa65 00000000000000", false}, // Not a run, but Sparse
+		{"0000000000000000 e47d253e45ccfa65", false},
+		{"e47d253e45ccfa65 0000000000000000", false},
 
 		// stuck bits tests (need 64 bytes for one bit set)
 		{"136d3d153516244b2a366d7b401131523d453b701f4b7c6d39480710561b5e0a136d3d153516244b2a366d7b401131523d453b701f4b7c6d39480710561b5e0a", false}, // 0x80 bit unset
@@ -76,6 +210,89 @@ func TestLooksRandom(t *testing.T) {
 		{"56876992848523349221444420808141305225040262090269175173423980997340449166172416814316656a", true},
 		{"56876992848523349221444420808141305225040262090F691751734239809973404491661724168143166566", true},
 
+		// Encoded instead of raw bytes: uppercase hex (need 16 or more
+		// bytes) and base32 (need 22 or more bytes)
+		{"42453544393646344137303237334339", false},
+		{"424535443936463441373032373345", true},
+		{"585a4f5a4e354648414a5a34535946545a59545a53374c4f4843464b5958544c", false},
+		{"585a4f5a4e354648414a5a34535946545a59545a533d3d3d", false},
+		{"585a4f5a4e354648414a5a34535946545a59545a53", true},
+
+		// Values in a truncated range (all bytes 0-15, 0-63)
+		{"080b000e070105030b0f070c03070006", false},
+		{"0d08050c0502040e04040000060605", true},
+		{"152528191a17193126022e35151221082a26002b08272d273d28173d3c160720", false},
+
+		// Buffers memset to one value and only partly overwritten
+		// (rngstat.ConstantFill tests)
+		{"20202020202020202020202020202020", false}, // memset of spaces
+		{"10101010101010101010101010101010", false}, // every byte is the length
+		{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", false},
+		// Nearly constant, broken up so there's no run of 9:
+		{"2020202020202000 2020202020202000", false},
+		{"20202020202020e4 20202020202020e4 2020202020202020 20202020202020e4", false},
+		{"2020202020200000 2020202000202020", false}, // Too many other bytes, but Sparse
+
+		// One value (usually zero) making up too much of the input
+		// (rngstat.Sparse tests)
+		// Half zeros is enough if the input is long
+		{"00e400000000007d00250000003e45000000cc00fa000065f40044004900930067007a00af000056ae13eda4bd9500b500001600000024", false},
+		{"00e4007d00250000003e4500cc00fa65f44493677aaf56ae", true},
+		// 90% zeros, in no particular order (no runs), is also Constant fill
+		{"00000000e4000000000000000000007d0000000000000000000000250000000000000000003e00000000000000000000450000000000", false},
+
+		// A constant with a little noise
+		// (rngstat.ConstantPlusNoise tests)
+		// 0x80 plus or minus 2
+		{"7f80827e81807e82 80817f807e82817f", false},
+		{"7f80827e81807e82 8081", true}, // Too short
+		// Around zero, wrapping
+		{"00fe0102ff00fe01 0200ff01fe020100", false},
+		// A few bytes off the baseline
+		{"7f80827e81807e82 80817f807e82817f 80e4807e81 7f8082 2580807f7e8180817f", false},
+		{"7f80827e81807e82 80817f807e82817f 80e4807e81 7f4582 2580807f7e8180817f", false},
+		{"7f80827e81807e82 e4817f457e82cc7f", true},
+		// Too much noise
+		{"7d80837e81847e82 80837f807d82857f", true},
+
+		// Bytes alternating between a high and a low range
+		// (rngstat.Alternating tests)
+		// Evens in c0..ff, odds in 00..3f
+		{"e913f206c90cee07db04cb37f508de0bf607cf1cc732c61cc511e535d20fe717cd18ef0cc807da3ff628fb3aee26df17", false},
+		{"df0ae63feb39e409cf35d52bd33ef505c928eb2cff3ac80be23cc807e739e431", true}, // Too short for such wide ranges
+		{"ff00ff00ff00ff00ff00", false},
+		{"00ff00ff00ff00ff00ff00", false},
+		{"ff00ff00ff00ff00ff", true},
+		{"40424143424041434241404243414240", false}, // Narrow and overlapping: not alternating, but Constant plus noise
+
+		// Nearly every byte with the same number of bits set
+		// (rngstat.ConstantWeight tests, need 64 bytes)
+		// Every byte has 4 bits set
+		{"c6cac6e15c5ae1cc5a39c68e4e36e827acc65517e42e2d1e5c6c1dca96c563e26a8dd40f35c987b23572956ae18b1d2e3ab13a8daa2e1b0f66652bcca9acb433", false},
+		// Every byte has 3 or 5 bits set
+		{"a2b33edac15264235d620b76d62a2f4cc8250b1989e38f38c2a13d85943dced92c79b670297379450752f4e3a85b0d433b73f2adb6a42515314583510bd9ae62", false},
+		{"8daa333336657117a6a6c94bd14daa5a53936a715c5563aad135b42b3a3a1ee1726cac72b4d28de2592e4b6ad1338766651b2e78b2c6712d27598ba6e44b36", true}, // Too short
+
+		// The same byte at every Nth position
+		// (rngstat.StridedStuck tests)
+		// a5 at every 4th byte, like a fixed struct field
+		{"fca5fb8bcfa5c0060ca5f82bb3a59e8215a575aedfa56a1bdda5032a68a517c9a2a55d4c08a52326ffa5d83e74a5cecf3da5d66fd9a5d545c4a50bc290a50ec6", false},
+		{"5c195c155c215c845cde5c895cd35c245cf15c", false},
+		{"5c195c155c215c845cde5c895cd35c245cf1", true}, // Only 9 5c's
+		// 3e at every 16th byte
+		{"93c6fef5d0776a3ed1e102c67408dcc25e228e416109873ef362e5a1b52512ae5e2fedaac454193e4d07e7db918d888115b532c33767cd3e73fc951a3108d54a48245975e305c13e7d72ae8d639b7f41cff488deca99d33ef70493e8bff3cb0c4cda469d212d103e6763c6eca5e2a24edf14a7f85d08713e599e7045a3a84f30993d6f407dee643ed4d570281235f2f8b6c4452b82de5f3eb2d17b179dc69fc7", false},
+		{"93c6fef5d0776a3ed1e102c67408dcc25e228e416109873ef362e5a1b52512ae5e2fedaac454193e4d07e7db918d888115b532c33767cd3e73fc951a3108d54a48245975e305c13e7d72ae8d639b7f41cff488deca99d33ef70493e8bff3cb0c4cda469d212d103e6763c6eca5e2a24edf14a7f85d08713e599e7045a3a84f30993d6f407dee643ed4d570281235f2f8b6c4452b82de5f", true}, // Only 9 3e's
+
+		// Bytes in nearly sorted order, from a broken shuffle
+		// (rngstat.NearlySorted tests)
+		// Sorted, then 12 adjacent pairs swapped
+		{"0502070c0c12151715191f2121222326252a2c323234394a444c4d605c6a727378857a8788898f8990969699999a9ea1a7afafb6b2bbbdc3c9ccd6def1f3dffd", false},
+		{"eededcc0bbb5b3aeaaa7a39e967d786f6c6c615c5a534e433838382921090904", false}, // Reverse sorted
+		// Sorted, then 48 of 128 bytes shuffled
+		{"00030b0d1127181922311d1d4e1f21a43492be802c282a2b252e2e3139c932881d2239303a563d3f3f1a4346474b4c534f60548059a55de164596a707174787c7e7f913d23848587cda88a8a8c8d8d8d12359395969798999b829f3244a9abacb1b5b6b8b9babdd5c18965c3c4c525dfcfd1d5c21cc2e0d7e5f0f3f4f7f8f9fc", false},
+		{"11191f33425a5b7a85888a9a9ba4aab0d8d9e6e7ff", false},
+		{"11191f33425a5b7a85888a9a9ba4aab0d8d9e6e7", true}, // 20! is under 2^65
+
 		// Actual random bitstreams, 1 to 32 bytes
 		{"8b", true},
 		{"6c72", true},
@@ -125,16 +342,885 @@ func TestLooksRandom(t *testing.T) {
 	}
 }
 
+func TestWarnings(t *testing.T) {
+	saved := detectors
+	defer func() { detectors = saved }()
+	detectors = append(detectors, detector{func(b []byte) bool { return b[0] == 0xe4 }, "Starts with e4", warn, 1})
+
+	b, _ := hex.DecodeString("e47d253e45ccfa65f44493677aaf56ae")
+	if got, which := LooksRandom(b); !got {
+		t.Errorf("LooksRandom(%x) = %v (%s), warning should not fail", b, got, which)
+	}
+	if got := Warnings(b); len(got) != 1 || got[0] != "Starts with e4" {
+		t.Errorf("Warnings(%x) = %q", b, got)
+	}
+	b, _ = hex.DecodeString("92f4752dbfcc23da433c9a8759cc67b330")
+	if got := Warnings(b); len(got) != 0 {
+		t.Errorf("Warnings(%x) = %q", b, got)
+	}
+	detectors = saved
+
+	var tests = []struct {
+		hexbytes string
+		want     string // "" for no warning
+	}{
+		// (rngstat.UUIDv1 tests)
+		// RFC 9562 example, 2022-02-22
+		{"c232ab00941411ecb3c89f6bdeced846", "Time-based UUID"},
+		{"c232ab00941411ecb3c89f6bdeced846 c232ab01941411ecb3c89f6bdeced846", "Time-based UUID"},
+		// Version 4
+		{"919108f752d133205bacf847db4148a8", ""},
+		// Timestamp in 1582
+		{"00000000000010008000000000000000", ""},
+		// Not a multiple of 16 bytes
+		{"c232ab00941411ecb3c89f6bdeced84600", ""},
+		// ... or one of the UUIDs isn't
+		{"c232ab00941411ecb3c89f6bdeced846 919108f752d133205bacf847db4148a8", ""},
+		{"e47d253e45ccfa65f44493677aaf56ae", ""},
+		// (rngstat.SequentialGUID tests)
+		// The RFC example's time from NEWSEQUENTIALID(), as its string decodes
+		{"00ab32c21494ec11b3c89f6bdeced846", "SQL Server sequential GUID"},
+		{"00ab32c21494ec11b3c89f6bdeced846 01ab32c21494ec11b3c89f6bdeced846", "SQL Server sequential GUID"},
+		// Going backwards
+		{"01ab32c21494ec11b3c89f6bdeced846 00ab32c21494ec11b3c89f6bdeced846", ""},
+		// From another machine
+		{"00ab32c21494ec11b3c89f6bdeced846 01ab32c21494ec11b3c89f6bdeced847", ""},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(strings.Replace(test.hexbytes, " ", "", -1))
+		if err != nil {
+			panic(err)
+		}
+		got := Warnings(b)
+		if (len(test.want) == 0 && len(got) != 0) || (len(test.want) > 0 && (len(got) != 1 || got[0] != test.want)) {
+			t.Errorf("Warnings(%q) = %q, want %q", test.hexbytes, got, test.want)
+		}
+		// A warning, not a failure
+		if ok, reason := LooksRandom(b); !ok && len(test.want) > 0 {
+			t.Errorf("LooksRandom(%q) = false (%s)", test.hexbytes, reason)
+		}
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	// Bytes that are one of only a few values
+	fewValues := func(n int, values int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(r.Intn(values)) * 37
+		}
+		return b
+	}
+	// Bytes with each bit set with probability p
+	fewBits := func(n int, p float64) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			for bit := uint(0); bit < 8; bit++ {
+				if r.Float64() < p {
+					b[i] |= 1 << bit
+				}
+			}
+		}
+		return b
+	}
+	var tests = []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"8 values, then random", append(fewValues(64, 8), random(192)...), true},
+		{"4 values, then random", append(fewValues(32, 4), random(96)...), true},
+		{"sparse bits, then random", append(fewBits(64, 0.1), random(448)...), true},
+		{"random", random(256), false},
+		{"random, long", random(4096), false},
+		{"too short", append(fewValues(32, 4), random(64)...), false},
+		{"64 values, then random", append(fewValues(64, 64), random(192)...), false},
+		// Not warming up; other tests catch this
+		{"8 values throughout", fewValues(256, 8), false},
+	}
+	for _, test := range tests {
+		if got := WarmUp(test.b); got != test.want {
+			t.Errorf("WarmUp(%s) = %v", test.name, got)
+		}
+	}
+}
+
+func TestRepeatedNonce(t *testing.T) {
+	var tests = []struct {
+		hexbytes string
+		size     int
+		want     bool
+	}{
+		// 12-byte nonces, the second and fourth the same
+		{"13edbd95b51624cbaa36ed7b c011b1523d453bf09f4b7c6d b9480790d61b5e0ae47d253e c011b1523d453bf09f4b7c6d", 12, true},
+		{"13edbd95b51624cbaa36ed7b c011b1523d453bf09f4b7c6d b9480790d61b5e0ae47d253e 45ccfa65f44493677aaf56ae", 12, false},
+		// Same bytes, as 16-byte nonces: no repeat
+		{"13edbd95b51624cbaa36ed7b c011b1523d453bf09f4b7c6d b9480790d61b5e0ae47d253e c011b1523d453bf09f4b7c6d", 16, false},
+		// Not a whole number of nonces
+		{"13edbd95b51624cbaa36ed7b c011b1523d453bf09f4b7c6d c011b1523d453bf09f4b7c6d 00", 12, false},
+		// 8-byte nonces are too short to say
+		{"13edbd95b51624cb 13edbd95b51624cb", 8, false},
+		{"13edbd95b51624cbaa 13edbd95b51624cbaa", 9, true},
+		{"13edbd95b51624cbaa36ed7b", 0, false},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(strings.Replace(test.hexbytes, " ", "", -1))
+		if err != nil {
+			panic(err)
+		}
+		if got := RepeatedNonce(b, test.size); got != test.want {
+			t.Errorf("RepeatedNonce(%q, %d) = %v", test.hexbytes, test.size, got)
+		}
+	}
+	b, _ := hex.DecodeString("13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0ae47d253ec011b1523d453bf09f4b7c6d")
+	if ok, reason := LooksRandom(b); ok || reason != "Repeated GCM nonce" {
+		t.Errorf("LooksRandom(repeated GCM nonce) = %v, %q", ok, reason)
+	}
+}
+
+func TestPassed(t *testing.T) {
+	counts := make(map[string]int)
+	for _, h := range []string{
+		"8b",
+		"e47d253e45ccfa65f44493677aaf56ae",
+		"0000000000000000 e47d253e45ccfa65",
+		"13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a",
+		"136d3d153516244b2a366d7b401131523d453b701f4b7c6d39480710561b5e0a136d3d153516244b2a366d7b401131523d453b701f4b7c6d39480710561b5e0a",
+	} {
+		b, _ := hex.DecodeString(strings.Replace(h, " ", "", -1))
+		for _, p := range Passed(b) {
+			counts[p]++
+		}
+	}
+	var tests = []struct {
+		reason string
+		want   int
+	}{
+		{"Repeated bytes", 3},
+		{"Counting", 4},
+		{"Hex digits as ASCII", 4},
+		{"Block counter", 2},
+		{"Bit stuck", 0},
+	}
+	for _, test := range tests {
+		if counts[test.reason] != test.want {
+			t.Errorf("%s passed %d times, want %d", test.reason, counts[test.reason], test.want)
+		}
+	}
+}
+
+func TestConstantPadding(t *testing.T) {
+	var tests = []struct {
+		hexbytes string
+		n        int
+		want     bool
+	}{
+		// Short read: 16 random bytes, then 16 bytes of zero-fill
+		{"e47d253e45ccfa65f44493677aaf56ae 00000000000000000000000000000000", 16, true},
+		{"e47d253e45ccfa65f44493677aaf56ae 00000000000000000000000000000000", 8, true},
+		{"e47d253e45ccfa65f44493677aaf56ae 00000000000000000000000000000000", 20, false},
+		// Too short a tail to be under the false positive rate:
+		{"e47d253e45ccfa65f44493677aaf56ae 00000000000000", 7, false},
+		// Tail isn't zero:
+		{"e47d253e45ccfa65f44493677aaf56ae 0000000000000001", 8, false},
+		{"e47d253e45ccfa65f44493677aaf56ae", 8, false},
+		// Shortfall bigger than the input, or no shortfall:
+		{"0000000000000000", 9, false},
+		{"0000000000000000", 0, false},
+		{"0000000000000000", -8, false},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(strings.Replace(test.hexbytes, " ", "", -1))
+		if err != nil {
+			panic(err)
+		}
+		if got := ConstantPadding(b, test.n); got != test.want {
+			t.Errorf("ConstantPadding(%q, %d) = %v", test.hexbytes, test.n, got)
+		}
+	}
+}
+
+func TestPopcountRamp(t *testing.T) {
+	// 21 6-byte segments with 4, 6, 8, ... 44 bits set, then 2 more bytes
+	ramp, _ := hex.DecodeString("0024000081000160408000102048400150010d0e420042008420410a041764109a81214421b5056a4402ba14425620f060e18d26829719cd0db553448dcf4c3f94416750aeef0f2aa8f5193bcdeed873f2f77ba4aebf7ce572cfc6b7ee6f9dfb2ff7d9db9ffdfedfabfbeded3bfff3f7beffff5bfffffbdeffbffb7fbfffd6f5")
+	random, _ := hex.DecodeString("69ef0ef625cc17ef7578236f827b6184465f12825617a05dd82e2b3c2f879512b6e7ac030faba9dfc2f8276bfac840a33d8c27dd39e08031bfbce6978736ad3afcb41e965d4c5bbde83f3748a9d7995feaf69f5a23365cc8b733888ac41b4515f58a7eb5aacee523b4fe394d8a3339395e60d5c8414acb63575b6780bd960fe3")
+	down := make([]byte, len(ramp))
+	for i, v := range ramp[:126] {
+		down[i] = ^v
+	}
+	var tests = []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"increasing", ramp, true},
+		{"decreasing", down, true},
+		{"too short", ramp[:126], false},
+		{"random", random, false},
+	}
+	for _, test := range tests {
+		if got := PopcountRamp(test.b); got != test.want {
+			t.Errorf("PopcountRamp(%s) = %v", test.name, got)
+		}
+	}
+}
+
+func TestMarkup(t *testing.T) {
+	var tests = []struct {
+		text string
+		want bool
+	}{
+		{`{"key": "value", "list": [1, 2, 3], "ok": true}`, true},
+		{`{"key": "value", "n": [1, 2, 3]}`, false}, // Too short to be sure
+		{"<rng><seed>42</seed><n>7</n><ok/></rng>", true},
+		{"{\n\t\"bytes\": \"e47d253e\",\n\t\"n\": 16,\n\t\"ok\": true\n}", true},
+		// Printable, but not much structure:
+		{"The quick brown fox jumps over the lazy dog. The end.", false},
+		{`Hello, world: this is "quoted" text [with] brackets`, false},
+		// Not text:
+		{"{\"key\": \"value\", \"list\": [1, 2, 3], \"ok\": true}\x00", false},
+	}
+	for _, test := range tests {
+		if got := Markup([]byte(test.text)); got != test.want {
+			t.Errorf("Markup(%q) = %v", test.text, got)
+		}
+	}
+	random, _ := hex.DecodeString("13edbd95b51624cbaa36ed7bc011b1523d453bf09f4b7c6db9480790d61b5e0a")
+	if Markup(random) {
+		t.Error("Markup(random bytes) = true")
+	}
+}
+
+func TestConstantWeight(t *testing.T) {
+	// Fixed vectors are in TestLooksRandom; random bytes never trip it
+	var random [128]byte
+	for i := 0; i < 1000; i++ {
+		rand.Read(random[:])
+		if ConstantWeight(random[:]) {
+			t.Fatalf("ConstantWeight(%x) = true", random)
+		}
+	}
+}
+
+func TestStuckStride(t *testing.T) {
+	b := make([]byte, 256)
+	for i := 0; i < 1000; i++ {
+		rand.Read(b)
+		if s := StuckStride(b); s != 0 {
+			t.Fatalf("StuckStride(%x) = %d", b, s)
+		}
+	}
+	for _, stride := range stuckStrides {
+		rand.Read(b)
+		for i := stride - 1; i < len(b); i += stride {
+			b[i] = 0x42
+		}
+		if s := StuckStride(b); s != stride {
+			t.Errorf("StuckStride(every %d) = %d", stride, s)
+		}
+		// In this much input Sparse catches the shorter strides first
+		want := "Strided stuck byte (stride " + strconv.Itoa(stride) + ")"
+		if _, reason := LooksRandom(b); stride == 16 && reason != want {
+			t.Errorf("LooksRandom(every %d) reason = %q, want %q", stride, reason, want)
+		}
+	}
+}
+
+func TestHexTextCounting(t *testing.T) {
+	b := make([]byte, 128)
+	for i := 0; i < 1000; i++ {
+		rand.Read(b)
+		if text := []byte(hex.EncodeToString(b[:9+i%120])); HexTextCounting(text) {
+			t.Fatalf("HexTextCounting(%s) = true", text)
+		}
+	}
+	text := []byte("00000001 00000002 00000003 00000004")
+	if ok, reason := LooksRandom(text); ok || reason != "Counter encoded as hex text" {
+		t.Errorf("LooksRandom(%s) = %v, %q", text, ok, reason)
+	}
+}
+
+func TestDuplicateBlocks(t *testing.T) {
+	b := make([]byte, maxInputBytes)
+	for i := 0; i < 100; i++ {
+		rand.Read(b)
+		if n := 24 + 40*i; DuplicateBlocks(b[:n]) {
+			t.Fatalf("DuplicateBlocks(%x) = true", b[:n])
+		}
+	}
+	rand.Read(b[:256])
+	copy(b[96:104], b[16:24])
+	if DuplicateBlocks(b[:256]) {
+		t.Error("DuplicateBlocks(one repeat) = true")
+	}
+	copy(b[192:200], b[16:24])
+	want := "Repeated 8-byte blocks (offsets 16 and 96, 16 and 192)"
+	if ok, reason := LooksRandom(b[:256]); ok || reason != want {
+		t.Errorf("LooksRandom(%x) = %v, %q, want %q", b[:256], ok, reason, want)
+	}
+}
+
+func TestJitteredCounter(t *testing.T) {
+	b := make([]byte, 256)
+	for i := 0; i < 1000; i++ {
+		rand.Read(b)
+		if JitteredCounter(b[:16+i%240]) {
+			t.Fatalf("JitteredCounter(%x) = true", b[:16+i%240])
+		}
+	}
+	// 64-bit big-endian counters with 2 noise bytes (LooksRandom
+	// reports these as a block counter)
+	noise := make([]byte, 8)
+	rand.Read(noise)
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint64(b[8*i:], (0x1d2c3b4a5968+uint64(i))<<16|uint64(binary.BigEndian.Uint16(noise[2*i:])))
+	}
+	if !JitteredCounter(b[:32]) {
+		t.Errorf("JitteredCounter(%x) = false", b[:32])
+	}
+}
+
+func TestNearlySorted(t *testing.T) {
+	b := make([]byte, 300)
+	for i := 0; i < 1000; i++ {
+		rand.Read(b)
+		if NearlySorted(b[:21+i%280]) {
+			t.Fatalf("NearlySorted(%x) = true", b[:21+i%280])
+		}
+	}
+}
+
+func TestPermutation(t *testing.T) {
+	b := make([]byte, 256)
+	for i := 0; i < 1000; i++ {
+		rand.Read(b)
+		if Permutation(b[:14+i%243]) {
+			t.Fatalf("Permutation(%x) = true", b[:14+i%243])
+		}
+	}
+	for i, v := range mathrand.Perm(256) {
+		b[i] = byte(v)
+	}
+	if ok, reason := LooksRandom(b); ok || reason != "Permutation of a byte range" {
+		t.Errorf("LooksRandom(%x) = %v, %q", b, ok, reason)
+	}
+	if permutationLog2(13) <= -64 || permutationLog2(14) > -64 {
+		t.Errorf("permutationLog2(13, 14) = %f, %f", permutationLog2(13), permutationLog2(14))
+	}
+}
+
+// The bound is never under the exact chance, from the number of
+// permutations of 8 with each number of inversions (Mahonian numbers)
+func TestInversionsTailLog2(t *testing.T) {
+	const n = 8
+	counts := []float64{1}
+	for j := 2; j <= n; j++ {
+		next := make([]float64, len(counts)+j-1)
+		for k, c := range counts {
+			for x := 0; x < j; x++ {
+				next[k+x] += c
+			}
+		}
+		counts = next
+	}
+	total, cumulative := 40320.0, 0.0
+	for k, c := range counts[:len(counts)/2] {
+		cumulative += c
+		if got := inversionsTailLog2(n, k); got < math.Log2(cumulative/total)-1e-9 {
+			t.Errorf("inversionsTailLog2(%d, %d) = %v, exact %v", n, k, got, math.Log2(cumulative/total))
+		}
+	}
+	// Sorted: 1/n!
+	if got := inversionsTailLog2(21, 0); math.Abs(got-math.Log2(1/5.109094217170944e19)) > 0.01 {
+		t.Errorf("inversionsTailLog2(21, 0) = %v", got)
+	}
+}
+
+func TestClustered(t *testing.T) {
+	// Bell curves of various widths, centered anywhere
+	r := mathrand.New(mathrand.NewSource(1))
+	var tests = []struct {
+		n      int
+		mean   float64
+		stddev float64
+		want   bool
+	}{
+		{32, 128, 3, true},
+		{64, 128, 8, true},
+		{64, 20, 8, true},
+		{256, 200, 20, true},
+		{1024, 128, 30, true},
+		{16, 128, 3, false}, // Too short
+		{256, 128, 60, false},
+	}
+	for _, test := range tests {
+		b := make([]byte, test.n)
+		for i := range b {
+			v := test.mean + test.stddev*r.NormFloat64()
+			b[i] = byte(math.Max(0, math.Min(255, v)))
+		}
+		if got := Clustered(b); got != test.want {
+			t.Errorf("Clustered(%d bytes, mean %v, stddev %v) = %v", test.n, test.mean, test.stddev, got)
+		}
+	}
+	// Uniform random bytes should never be flagged
+	for n := 32; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if Clustered(b) {
+			t.Errorf("Clustered(%x) = true", b)
+		}
+	}
+}
+
+// Library users can call the tests directly, on inputs /v1/q would reject
+func TestShortInputs(t *testing.T) {
+	for _, b := range [][]byte{nil, {}, {0x00}, {0xff}, {0x41}} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("panic on %x: %v", b, r)
+				}
+			}()
+			for _, d := range detectors {
+				if d.test(b) {
+					t.Errorf("%s(%x) = true", d.reason, b)
+				}
+			}
+			if ok, reason := LooksRandom(b); !ok {
+				t.Errorf("LooksRandom(%x) = false (%s)", b, reason)
+			}
+			if w := Warnings(b); len(w) != 0 {
+				t.Errorf("Warnings(%x) = %q", b, w)
+			}
+			if p := Passed(b); len(p) != 0 {
+				t.Errorf("Passed(%x) = %q", b, p)
+			}
+			if ConstantPadding(b, 8) || ConstantPadding(b, -1) {
+				t.Errorf("ConstantPadding(%x) = true", b)
+			}
+			if k := KnownKey(b); k != "" {
+				t.Errorf("KnownKey(%x) = %q", b, k)
+			}
+		}()
+	}
+}
+
+func TestConstantPlusNoise(t *testing.T) {
+	// Fixed vectors are in TestLooksRandom; uniform random bytes never are
+	for n := 16; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if ConstantPlusNoise(b) {
+			t.Errorf("ConstantPlusNoise(%x) = true", b)
+		}
+	}
+}
+
+func TestUninitializedMemory(t *testing.T) {
+	for _, f := range memoryFills {
+		fill := bytes.Repeat(f.pattern, 16/len(f.pattern))
+		if ok, reason := LooksRandom(fill); ok || reason != "Looks like uninitialized memory: "+f.name+" fill" {
+			t.Errorf("LooksRandom(%x) = %v, %q", fill, ok, reason)
+		}
+		// Part of a buffer, at any phase
+		b := make([]byte, 64)
+		rand.Read(b)
+		copy(b[21:], fill[1:])
+		if got := memoryFill(b); got != f.name {
+			t.Errorf("memoryFill(%x) = %q, want %q", b, got, f.name)
+		}
+		copy(b[21:], fill[1:9]) // 8 bytes aren't enough
+		b[20], b[29] = 0, 0
+		if got := memoryFill(b); got == f.name {
+			t.Errorf("memoryFill(%x) = %q", b, got)
+		}
+	}
+	// Little-endian
+	if got := memoryFill([]byte("\xef\xbe\xad\xde\xef\xbe\xad\xde\xef\xbe\xad\xde")); got != "0xDEADBEEF" {
+		t.Errorf("memoryFill(little-endian deadbeef) = %q", got)
+	}
+	for n := 16; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if UninitializedMemory(b) {
+			t.Errorf("UninitializedMemory(%x) = true", b)
+		}
+	}
+}
+
+func TestPEMArmor(t *testing.T) {
+	pem := "-----BEGIN PUBLIC KEY-----\n" +
+		"MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEEVs/o5+uQbTjL3chynL4wXgUg2R9\n" +
+		"q9UU8I5mEovUf86QZ7kOBIjJwqnzD1omageEHWwHdBO6B+dFabmdT9POxg==\n" +
+		"-----END PUBLIC KEY-----\n"
+	var tests = []struct {
+		b    string
+		want string
+	}{
+		{pem, "PEM-armored text (PUBLIC KEY)"},
+		{pem[len(pem)-64:], "PEM-armored text (PUBLIC KEY)"}, // Just the END line
+		{strings.Replace(pem, "PUBLIC KEY", "RSA PRIVATE KEY", -1), "PEM-armored text (RSA PRIVATE KEY)"},
+		{base64.StdEncoding.EncodeToString([]byte(pem)), "PEM-armored text (base64-encoded)"},
+	}
+	for _, test := range tests {
+		if ok, reason := LooksRandom([]byte(test.b)); ok || reason != test.want {
+			t.Errorf("LooksRandom(%q) = %v, %q, want %q", test.b, ok, reason, test.want)
+		}
+	}
+	for _, s := range []string{"-----BEGIN -----", "-----BEGIN public key-----", "-----BEGIN PUBLIC KEY"} {
+		if PEMArmor([]byte(s)) {
+			t.Errorf("PEMArmor(%q) = true", s)
+		}
+	}
+	for n := 16; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if PEMArmor(b) {
+			t.Errorf("PEMArmor(%x) = true", b)
+		}
+	}
+}
+
+func TestFramedConstant(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	// n bytes of records: zero padding, then payload bytes at the end
+	framed := func(n int, record int, payload int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			if i%record >= record-payload {
+				b[i] = byte(1 + r.Intn(255))
+			}
+		}
+		return b
+	}
+	for _, test := range [][3]int{{64, 8, 2}, {64, 8, 3}, {15, 3, 1}, {256, 12, 5}, {4096, 4, 1}} {
+		b := framed(test[0], test[1], test[2])
+		if Repeated(b) {
+			t.Errorf("Repeated(%x) = true", b)
+		}
+		if ok, reason := LooksRandom(b); ok || reason != "Constant framing with periodic payload" {
+			t.Errorf("LooksRandom(%x) = %v, %q", b, ok, reason)
+		}
+	}
+	// Half padding isn't enough framing
+	if b := framed(64, 8, 4); FramedConstant(b) {
+		t.Errorf("FramedConstant(%x) = true", b)
+	}
+	// One stray byte isn't a payload
+	stray := make([]byte, 32)
+	stray[5] = 0x42
+	if ok, reason := LooksRandom(stray); ok || reason != "Constant fill" {
+		t.Errorf("LooksRandom(%x) = %v, %q", stray, ok, reason)
+	}
+	for n := 16; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if FramedConstant(b) {
+			t.Errorf("FramedConstant(%x) = true", b)
+		}
+	}
+}
+
+func TestSequentialGUID(t *testing.T) {
+	// Consecutive NEWSEQUENTIALID() values, including a carry out of
+	// the first four bytes
+	var b []byte
+	for _, h := range []string{"fdffffff1494ec11b3c89f6bdeced846", "feffffff1494ec11b3c89f6bdeced846",
+		"ffffffff1494ec11b3c89f6bdeced846", "000000001594ec11b3c89f6bdeced846"} {
+		g, _ := hex.DecodeString(h)
+		b = append(b, g...)
+	}
+	if !SequentialGUID(b) {
+		t.Errorf("SequentialGUID(%x) = false", b)
+	}
+	if UUIDv1(b) {
+		t.Errorf("UUIDv1(%x) = true", b)
+	}
+	if SequentialGUID(b[:63]) {
+		t.Errorf("SequentialGUID(%x) = true", b[:63])
+	}
+	for n := 16; n <= 4096; n *= 2 {
+		r := make([]byte, n)
+		rand.Read(r[16:])
+		copy(r, b[:16]) // Even after one that looks like it
+		if SequentialGUID(r) != (n == 16) {
+			t.Errorf("SequentialGUID(%x) = %v", r, !(n == 16))
+		}
+	}
+}
+
+// n bytes that are 0x5a, or 0x5a with one bit flipped
+func oneBitStream(r *mathrand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 0x5a
+		if bit := r.Intn(9); bit < 8 {
+			b[i] ^= 1 << uint(bit)
+		}
+	}
+	return b
+}
+
+func TestOneBitNoise(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	if ok, reason := LooksRandom(oneBitStream(r, 64)); ok || reason != "One bit per byte varies" {
+		t.Errorf("LooksRandom(64 one-bit bytes) = %v, %q", ok, reason)
+	}
+	// Longer ones have enough unflipped bytes for Sparse to go first
+	for _, n := range []int{64, 256, 4096} {
+		b := oneBitStream(r, n)
+		if BitStuck(b) {
+			t.Errorf("BitStuck(%x) = true", b)
+		}
+		// A few stray bytes don't hide it
+		copy(b, []byte{0x00, 0xff, 0x33, 0xcc})
+		if !OneBitNoise(b) {
+			t.Errorf("OneBitNoise(%x) = false", b)
+		}
+	}
+	if OneBitNoise(oneBitStream(r, 63)) {
+		t.Error("OneBitNoise(63 bytes) = true")
+	}
+	for n := 64; n <= 4096; n *= 2 {
+		b := make([]byte, n)
+		rand.Read(b)
+		if OneBitNoise(b) {
+			t.Errorf("OneBitNoise(%x) = true", b)
+		}
+	}
+}
+
+// n bytes from a Fibonacci LFSR with the given number of bits and
+// taps (bit positions, counting from 1), most significant bit first
+func lfsr(bits uint, taps []uint, n int) []byte {
+	state := uint64(1)
+	b := make([]byte, n)
+	for i := 0; i < 8*n; i++ {
+		out := state & 1
+		fb := uint64(0)
+		for _, t := range taps {
+			fb ^= state >> (bits - t) & 1
+		}
+		state = state>>1 | fb<<(bits-1)
+		b[i/8] |= byte(out) << uint(7-i%8)
+	}
+	return b
+}
+
+func TestBitPeriodic(t *testing.T) {
+	r := mathrand.New(mathrand.NewSource(1))
+	random := make([]byte, 4096)
+	r.Read(random)
+	noisy := lfsr(7, []uint{7, 6}, 128) // Period 127 bits
+	for i := 0; i < 8; i++ {
+		noisy[r.Intn(len(noisy))] ^= 1 << uint(r.Intn(8))
+	}
+	var tests = []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"5-bit LFSR", lfsr(5, []uint{5, 3}, 64), true},
+		{"7-bit LFSR", lfsr(7, []uint{7, 6}, 64), true},
+		{"7-bit LFSR, 8 bits flipped", noisy, true},
+		{"8-bit LFSR", lfsr(8, []uint{8, 6, 5, 4}, 256), true},
+		{"31-bit LFSR", lfsr(31, []uint{31, 28}, 4096), false},
+		{"random", random, false},
+		{"random (64 bytes)", random[:64], false},
+		{"too short", lfsr(5, []uint{5, 3}, 63), false},
+	}
+	for _, test := range tests {
+		if got := BitPeriodic(test.b); got != test.want {
+			t.Errorf("BitPeriodic(%s) = %v", test.name, got)
+		}
+	}
+	if ok, reason := LooksRandom(lfsr(5, []uint{5, 3}, 64)); ok || reason != "Short bit period (LFSR)" {
+		t.Errorf("LooksRandom(5-bit LFSR) = %v, %q", ok, reason)
+	}
+}
+
+func TestMinBytesForFullCoverage(t *testing.T) {
+	// PopcountRamp and WarmUp need 128 bytes; update this if a test
+	// needing more is added.
+	if got := MinBytesForFullCoverage(); got != 128 {
+		t.Errorf("MinBytesForFullCoverage() = %d, want 128", got)
+	}
+	saved := detectors
+	defer func() { detectors = saved }()
+	detectors = append(detectors, detector{func(b []byte) bool { return false }, "Long", fail, 1000})
+	if got := MinBytesForFullCoverage(); got != 1000 {
+		t.Errorf("MinBytesForFullCoverage() with a 1000-byte test = %d", got)
+	}
+}
+
+func TestMinLengthAt(t *testing.T) {
+	reasons := map[string]bool{}
+	for _, d := range detectors {
+		reasons[d.reason] = true
+		f, ok := minLengthAt[d.reason]
+		if !ok {
+			continue
+		}
+		if got := f(defaultFalsePositiveBits); got != d.minLength {
+			t.Errorf("minLengthAt[%q](%d) = %d, want %d", d.reason, defaultFalsePositiveBits, got, d.minLength)
+		}
+		for bits := minFalsePositiveBits; bits < maxFalsePositiveBits; bits++ {
+			if f(bits+1) < f(bits) {
+				t.Errorf("minLengthAt[%q] shorter at %d bits than %d", d.reason, bits+1, bits)
+			}
+		}
+	}
+	for reason := range minLengthAt {
+		if !reasons[reason] {
+			t.Errorf("minLengthAt has %q, which isn't a detector", reason)
+		}
+	}
+}
+
+// A stricter budget needs longer inputs, so the shortest ones that
+// failed pass
+func TestFalsePositiveBits(t *testing.T) {
+	defer setFalsePositiveBits(defaultFalsePositiveBits)
+	counting := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if ok, reason := LooksRandom(counting[:9]); ok || reason != "Counting" {
+		t.Errorf("LooksRandom(9 counting bytes) = %v, %q", ok, reason)
+	}
+	setFalsePositiveBits(72)
+	if l := testList(); l.Tests[detectorIndex("Counting")].MinLength != 10 || l.MinBytesForFullCoverage != 128 {
+		t.Errorf("testList() at 72 bits = %+v", l)
+	}
+	if ok, reason := LooksRandom(counting[:9]); !ok {
+		t.Errorf("LooksRandom(9 counting bytes) at 72 bits = %v, %q", ok, reason)
+	}
+	if ok, reason := LooksRandom(counting); ok || reason != "Counting" {
+		t.Errorf("LooksRandom(10 counting bytes) at 72 bits = %v, %q", ok, reason)
+	}
+	for _, reason := range Passed(counting[:9]) {
+		if reason == "Counting" {
+			t.Error("Counting ran on 9 bytes at 72 bits")
+		}
+	}
+	setFalsePositiveBits(minFalsePositiveBits)
+	if ok, reason := LooksRandom(counting[:7]); ok || reason != "Counting" {
+		t.Errorf("LooksRandom(7 counting bytes) at %d bits = %v, %q", minFalsePositiveBits, ok, reason)
+	}
+}
+
+func detectorIndex(reason string) int {
+	for i, d := range detectors {
+		if d.reason == reason {
+			return i
+		}
+	}
+	return -1
+}
+
+// LooksRandom without the compiled pipeline: every failing detector,
+// whatever the input's length
+func looksRandomUncompiled(b []byte) (bool, string) {
+	if name := KnownKey(b); len(name) > 0 {
+		return false, "Known test key: " + name
+	}
+	for _, d := range detectors {
+		if d.severity == fail && d.test(b) {
+			if detail, ok := detectorDetails[d.reason]; ok {
+				return false, d.reason + detail(b)
+			}
+			return false, d.reason
+		}
+	}
+	return true, ""
+}
+
+func TestPipeline(t *testing.T) {
+	defer setFalsePositiveBits(defaultFalsePositiveBits)
+	r := mathrand.New(mathrand.NewSource(1))
+	inputs := map[string]func(n int) []byte{
+		"random": func(n int) []byte {
+			b := make([]byte, n)
+			r.Read(b)
+			return b
+		},
+		"zeros": func(n int) []byte { return make([]byte, n) },
+		"counting": func(n int) []byte {
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			return b
+		},
+		"text": func(n int) []byte {
+			return []byte(strings.Repeat("{\"key\": \"0123456789abcdef\"}\n", n/10+1)[:n])
+		},
+		"narrow": func(n int) []byte {
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = byte(r.Intn(6))
+			}
+			return b
+		},
+		"one bit": func(n int) []byte { return oneBitStream(r, n) },
+	}
+	for _, bits := range []int{minFalsePositiveBits, defaultFalsePositiveBits, maxFalsePositiveBits} {
+		setFalsePositiveBits(bits)
+		for name, input := range inputs {
+			for n := 0; n <= 300; n++ {
+				b := input(n)
+				ok, reason := LooksRandom(b)
+				if wantOK, want := looksRandomUncompiled(b); ok != wantOK || reason != want {
+					t.Errorf("%d bits, %d %s bytes: LooksRandom = %v, %q; uncompiled %v, %q", bits, n, name, ok, reason, wantOK, want)
+				}
+			}
+		}
+	}
+
+	// Short inputs skip the tests that can't fail them
+	setFalsePositiveBits(defaultFalsePositiveBits)
+	p := compiledPipeline()
+	if got := p.stage(7); len(got) != 0 {
+		t.Errorf("stage(7) has %d detectors", len(got))
+	}
+	if got, all := len(p.stage(16)), len(p.stage(128)); got == 0 || got >= all {
+		t.Errorf("stage(16) has %d detectors, stage(128) %d", got, all)
+	}
+	if p.stage(1 << 20)[0].reason != detectors[0].reason {
+		t.Errorf("stage(1<<20) starts with %q", p.stage(1 << 20)[0].reason)
+	}
+}
+
 func BenchmarkLooksRandom(b *testing.B) {
-	var rhash [128]byte
+	benchmarkLooksRandom(b, LooksRandom, 128)
+}
+
+func BenchmarkLooksRandomUncompiled(b *testing.B) {
+	benchmarkLooksRandom(b, looksRandomUncompiled, 128)
+}
+
+func BenchmarkLooksRandomShort(b *testing.B) {
+	benchmarkLooksRandom(b, LooksRandom, 16)
+}
+
+func BenchmarkLooksRandomShortUncompiled(b *testing.B) {
+	benchmarkLooksRandom(b, looksRandomUncompiled, 16)
+}
+
+func benchmarkLooksRandom(b *testing.B, looksRandom func([]byte) (bool, string), n int) {
+	rhash := make([]byte, n)
 	for i := 0; i < b.N; i++ {
-		_, err := rand.Read(rhash[:])
+		_, err := rand.Read(rhash)
 		if err != nil {
 			panic(err)
 		}
-		r, t := LooksRandom(rhash[:])
+		r, t := looksRandom(rhash)
 		if r == false {
-			b.Errorf("%s failed LooksRandom (%s)", hex.EncodeToString(rhash[:]), t)
+			b.Errorf("%s failed LooksRandom (%s)", hex.EncodeToString(rhash), t)
 		}
 	}
 }
@@ -3,17 +3,31 @@ package randomsanity
 import (
 	"appengine"
 	"appengine/memcache"
-	"fmt"
+	"encoding/json"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Memcache doesn't return an item's expiration, so when a count
+// starts RateLimitCost also stores when it will start over, under
+// the key plus this (see rateLimitHandler)
+const rateLimitResetSuffix = ":reset"
+
 // Limit something (identified by key) to at most max per timespan
 // State stored in the memcache, so this is "best-effort"
 // Returns true if rate limit is hit.
 func RateLimit(ctx appengine.Context, key string, max uint64, timespan time.Duration) (bool, error) {
-	value, err := memcache.Increment(ctx, key, -1, max+1)
+	return RateLimitCost(ctx, key, 1, max, timespan)
+}
+
+// Like RateLimit, but uses up cost of the max at once (e.g. one per
+// value in a batch). cost must be at least 1.
+func RateLimitCost(ctx appengine.Context, key string, cost uint64, max uint64, timespan time.Duration) (bool, error) {
+	value, err := memcache.Increment(ctx, key, -int64(cost), max+1)
 	if err != nil {
 		return false, err
 	}
@@ -21,9 +35,9 @@ func RateLimit(ctx appengine.Context, key string, max uint64, timespan time.Dura
 	if value == 0 {
 		return true, nil
 	}
-	// value max means it wasn't set before, so
+	// value max+1-cost means it wasn't set before, so
 	// rewrite to set correct expiration time:
-	if value == max {
+	if value == max+1-cost {
 		item, err := memcache.Get(ctx, key)
 		if err != nil {
 			return false, err
@@ -32,26 +46,183 @@ func RateLimit(ctx appengine.Context, key string, max uint64, timespan time.Dura
 		// There is a race condition here, but it is mostly harmless
 		// (extra requests above the rate limit could slip through)
 		memcache.Set(ctx, item)
+		reset := strconv.FormatInt(time.Now().Add(timespan).Unix(), 10)
+		memcache.Set(ctx, &memcache.Item{Key: key + rateLimitResetSuffix, Value: []byte(reset), Expiration: timespan})
 	}
 	return false, nil
 }
 
 // Rate limit, and write stuff to w:
-func RateLimitResponse(ctx appengine.Context, w http.ResponseWriter, key string, max uint64, timespan time.Duration) (bool, error) {
-	limit, err := RateLimit(ctx, key, max, timespan)
+// (requests from our own services are exempt, see servicetoken.go)
+func RateLimitResponse(ctx appengine.Context, w http.ResponseWriter, r *http.Request, key string, max uint64, timespan time.Duration) (bool, error) {
+	return RateLimitCostResponse(ctx, w, r, key, 1, max, timespan)
+}
+
+// RateLimitCost, and write stuff to w
+func RateLimitCostResponse(ctx appengine.Context, w http.ResponseWriter, r *http.Request, key string, cost uint64, max uint64, timespan time.Duration) (bool, error) {
+	if serviceRequest(ctx, r) {
+		return false, nil
+	}
+	limit, err := RateLimitCost(ctx, key, cost, max, timespan)
 	if err != nil {
-		http.Error(w, "RateLimit error", http.StatusInternalServerError)
+		sendError(w, r, http.StatusInternalServerError, "ratelimit_error", "RateLimit error")
 		return false, err
 	}
 	if limit {
-		w.Header().Add("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusTooManyRequests)
-		fmt.Fprint(w, "Request limit exceeded")
+		sendRateLimited(w, r, timespan)
 		return true, nil
 	}
 	return false, nil
 }
 
+// A rate limit's current state, for support to see why a client is
+// being limited
+type RateLimitState struct {
+	Key       string
+	Counted   bool   // false if nothing is counted against Key (or memcache evicted it)
+	Remaining uint64 // Requests left before Reset
+	Limited   bool   // The last request was limited
+	Reset     int64  // Unix time the count starts over; 0 if unknown
+}
+
+// Returns the state of key's rate limit given the values memcache has
+// for key and key+rateLimitResetSuffix (nil if it doesn't have them).
+// The count is decremented from max+1 (see RateLimitCost), so it is
+// one more than the requests left, and 0 once limited.
+func rateLimitState(key string, count []byte, reset []byte) RateLimitState {
+	result := RateLimitState{Key: key}
+	n, err := strconv.ParseUint(string(count), 10, 64)
+	if count == nil || err != nil {
+		return result
+	}
+	result.Counted = true
+	if n == 0 {
+		result.Limited = true
+	} else {
+		result.Remaining = n - 1
+	}
+	result.Reset, _ = strconv.ParseInt(string(reset), 10, 64)
+	return result
+}
+
+// Returns the rate limit key that query asks about: key=<memcache key>,
+// or the /v1/q submission bucket for ip=<address>, id=<user id> or
+// id=<user id>&tag=<tag> (see submissionLimits)
+func rateLimitKey(query url.Values) string {
+	switch {
+	case len(query.Get("key")) > 0:
+		return query.Get("key")
+	case len(query.Get("ip")) > 0:
+		return IPKey("q", query.Get("ip"))
+	case len(query.Get("id")) > 0 && len(query.Get("tag")) > 0:
+		return "qtag:" + query.Get("id") + ":" + query.Get("tag")
+	case len(query.Get("id")) > 0:
+		return "quser:" + query.Get("id")
+	}
+	return ""
+}
+
+// GET /v1/ratelimit?ip=... (or id=, id=&tag=, key=) returns a
+// RateLimitState as JSON. Nothing is counted or changed.
+// Only admins can call this (see app.yaml).
+func rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	key := rateLimitKey(r.URL.Query())
+	if len(key) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_key", "Must provide key, ip or id")
+		return
+	}
+	ctx := appengine.NewContext(r)
+	items, err := memcache.GetMulti(ctx, []string{key, key + rateLimitResetSuffix})
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "memcache_error", "Memcache error")
+		return
+	}
+	var count, reset []byte
+	if item, ok := items[key]; ok {
+		count = item.Value
+	}
+	if item, ok := items[key+rateLimitResetSuffix]; ok {
+		reset = item.Value
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rateLimitState(key, count, reset))
+}
+
+// Proxies (as CIDRs, e.g. "10.0.0.0/8") trusted to tell us the
+// client's real address in X-Forwarded-For or Forwarded headers.
+// On App Engine r.RemoteAddr is already the client's address, so
+// this is only needed when running behind another load balancer.
+// Those headers are ignored on requests that don't come from one of
+// these, because anybody can send them.
+var trustedProxies = []string{}
+
+// Returns the address of the client that sent r
+func clientIP(r *http.Request, proxies []string) string {
+	addr := stripPort(r.RemoteAddr)
+	if !inNets(addr, proxies) {
+		return addr
+	}
+	hops := forwardedFor(r)
+	// Walk back from the hop nearest to us; the first address that isn't
+	// one of our proxies is the client. Anything before it could have
+	// been made up by the client.
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		addr = hops[i]
+		if !inNets(addr, proxies) {
+			break
+		}
+	}
+	return addr
+}
+
+// Returns the addresses in r's Forwarded (RFC 7239) or X-Forwarded-For
+// headers, client first
+func forwardedFor(r *http.Request) []string {
+	var result []string
+	if fwd := r.Header["Forwarded"]; len(fwd) > 0 {
+		for _, elem := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[0:4], "for=") {
+					result = append(result, stripPort(strings.Trim(pair[4:], "\"")))
+				}
+			}
+		}
+		return result
+	}
+	for _, xff := range r.Header["X-Forwarded-For"] {
+		for _, a := range strings.Split(xff, ",") {
+			result = append(result, stripPort(strings.TrimSpace(a)))
+		}
+	}
+	return result
+}
+
+// "1.2.3.4:80" -> "1.2.3.4", "[::1]:80" -> "::1", "::1" -> "::1"
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// Returns true if ip is in one of the CIDRs in nets
+func inNets(ip string, nets []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range nets {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
 // Get a reasonable memcache key from IPv4 or IPv6 address
 func IPKey(prefix string, ipaddr string) string {
 	// If it is a super-long IPv6: use first four parts
@@ -0,0 +1,106 @@
+package randomsanity
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "2001:db8::/32"}
+	var tests = []struct {
+		remote  string
+		header  string
+		value   string
+		proxies []string
+		want    string
+	}{
+		// No proxy:
+		{"192.0.2.1", "", "", proxies, "192.0.2.1"},
+		{"192.0.2.1:1234", "", "", proxies, "192.0.2.1"},
+		{"2001:db9::1", "", "", proxies, "2001:db9::1"},
+		// Spoofed; request didn't come from a trusted proxy:
+		{"192.0.2.1", "X-Forwarded-For", "198.51.100.7", proxies, "192.0.2.1"},
+		{"192.0.2.1", "Forwarded", "for=198.51.100.7", proxies, "192.0.2.1"},
+		{"10.1.2.3", "X-Forwarded-For", "198.51.100.7", nil, "10.1.2.3"},
+		// Trusted proxy:
+		{"10.1.2.3", "X-Forwarded-For", "198.51.100.7", proxies, "198.51.100.7"},
+		{"10.1.2.3:80", "X-Forwarded-For", "198.51.100.7, 10.9.9.9", proxies, "198.51.100.7"},
+		{"[2001:db8::5]:443", "Forwarded", `for="[2001:db9::17]:4711";proto=https`, proxies, "2001:db9::17"},
+		{"10.1.2.3", "Forwarded", "for=192.0.2.60;proto=http, for=10.2.2.2", proxies, "192.0.2.60"},
+		// Client tried to spoof, but the proxy appended the real address:
+		{"10.1.2.3", "X-Forwarded-For", "1.1.1.1, 198.51.100.7", proxies, "198.51.100.7"},
+		// Garbage, or no header at all:
+		{"10.1.2.3", "X-Forwarded-For", "unknown", proxies, "10.1.2.3"},
+		{"10.1.2.3", "", "", proxies, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/v1/q/00", nil)
+		r.RemoteAddr = test.remote
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := clientIP(r, test.proxies); got != test.want {
+			t.Errorf("clientIP(%s, %s: %s) = %s, want %s", test.remote, test.header, test.value, got, test.want)
+		}
+	}
+}
+
+func TestRateLimitState(t *testing.T) {
+	if s := rateLimitState("q192.0.2.1", nil, nil); s.Counted || s.Limited {
+		t.Errorf("rateLimitState(not counted) = %+v", s)
+	}
+	// Count requests the way memcache.Increment does in RateLimitCost:
+	// starting from max+1, never going under 0
+	const max = 5
+	count := uint64(max+1) - (max - 1) // After max-1 requests
+	reset := []byte("1500003600")
+	s := rateLimitState("q192.0.2.1", []byte(strconv.FormatUint(count, 10)), reset)
+	if s != (RateLimitState{"q192.0.2.1", true, 1, false, 1500003600}) {
+		t.Errorf("rateLimitState(one left) = %+v", s)
+	}
+	for i := 0; i < 2; i++ { // The last one, and one that is limited
+		if count > 0 {
+			count--
+		}
+	}
+	s = rateLimitState("q192.0.2.1", []byte(strconv.FormatUint(count, 10)), reset)
+	if s != (RateLimitState{"q192.0.2.1", true, 0, true, 1500003600}) {
+		t.Errorf("rateLimitState(limited) = %+v", s)
+	}
+	// Rate limits counted before reset times were stored
+	if s := rateLimitState("q192.0.2.1", []byte("3"), nil); !s.Counted || s.Remaining != 2 || s.Reset != 0 {
+		t.Errorf("rateLimitState(no reset) = %+v", s)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	var tests = []struct {
+		query string
+		want  string
+	}{
+		{"ip=192.0.2.1", IPKey("q", "192.0.2.1")},
+		{"ip=2001:db8:1:2:3:4:5:6", "q2001:db8:1:2"},
+		{"id=abc123", "quser:abc123"},
+		{"id=abc123&tag=prod", "qtag:abc123:prod"},
+		{"key=emailreg", "emailreg"},
+		{"tag=prod", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		q, _ := url.ParseQuery(test.query)
+		if got := rateLimitKey(q); got != test.want {
+			t.Errorf("rateLimitKey(%s) = %q, want %q", test.query, got, test.want)
+		}
+	}
+	// The same keys /v1/q counts against
+	s := defaultSettings
+	limits := submissionLimits("192.0.2.1", "abc123", "prod", s, nil)
+	for i, query := range []string{"id=abc123&tag=prod", "id=abc123", "ip=192.0.2.1"} {
+		q, _ := url.ParseQuery(query)
+		if rateLimitKey(q) != limits[i].key {
+			t.Errorf("rateLimitKey(%s) = %q, /v1/q uses %q", query, rateLimitKey(q), limits[i].key)
+		}
+	}
+}
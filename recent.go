@@ -0,0 +1,95 @@
+package randomsanity
+
+// A misconfigured client can submit the same bytes over and over.
+// Failures are remembered for a while per client address, so a repeat
+// is answered from memcache without running the tests or touching
+// the uniqueness database again (and without more notifications).
+// Passes are not: the same bytes twice from one address (cloned VMs
+// behind one NAT) is exactly what the uniqueness check is for, and a
+// pass might only be because the check was skipped (X-Uniqueness).
+//
+// Registered users' failures are remembered for longer, from any
+// address, so a client that resubmits old bad bytes after fixing a
+// bug is told that those bytes were already flagged, and when.
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	recentSubmissionExpiration = 10 * time.Minute
+	flaggedExpiration          = 7 * 24 * time.Hour
+)
+
+// Returns the memcache key for bytes b submitted from ip to namespace ns.
+// Hashed, so the bytes aren't kept in memcache.
+func recentKey(ns string, ip string, b []byte) string {
+	h := sha256.New()
+	h.Write([]byte(ns))
+	h.Write([]byte{0})
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write(b)
+	return "recent" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the result (see sendResult) sent the last time key was seen, if any
+func recentVerdict(ctx appengine.Context, key string) (string, bool) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil {
+		return "", false
+	}
+	return string(item.Value), true
+}
+
+// Only verdicts that resubmitting can't change are remembered
+func cacheableVerdict(result string) bool {
+	return result == resultNotRandom || result == resultNotUnique
+}
+
+// Best-effort, like the rest of memcache
+func rememberVerdict(ctx appengine.Context, key string, result string) {
+	if !cacheableVerdict(result) {
+		return
+	}
+	memcache.Set(ctx, &memcache.Item{Key: key, Value: []byte(result), Expiration: recentSubmissionExpiration})
+}
+
+// A registered user's earlier failed submission
+type flaggedSubmission struct {
+	Result string // not_random or not_unique
+	Reason string
+	Time   int64
+}
+
+// Returns the memcache key for bytes b submitted by user uID to
+// namespace ns
+func flaggedKey(ns string, uID string, b []byte) string {
+	h := sha256.New()
+	h.Write([]byte(ns))
+	h.Write([]byte{0})
+	h.Write([]byte(uID))
+	h.Write([]byte{0})
+	h.Write(b)
+	return "flagged" + hex.EncodeToString(h.Sum(nil))
+}
+
+func previouslyFlagged(ctx appengine.Context, key string) (flaggedSubmission, bool) {
+	var f flaggedSubmission
+	_, err := memcache.JSON.Get(ctx, key, &f)
+	return f, err == nil
+}
+
+func rememberFlagged(ctx appengine.Context, key string, f flaggedSubmission) {
+	memcache.JSON.Set(ctx, &memcache.Item{Key: key, Object: f, Expiration: flaggedExpiration})
+}
+
+// X-Warning for a resubmission of f's bytes
+func flaggedWarning(f flaggedSubmission) string {
+	return fmt.Sprintf("Already flagged (%s) at %s", f.Reason, time.Unix(f.Time, 0).UTC().Format(time.RFC3339))
+}
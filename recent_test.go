@@ -0,0 +1,64 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+func TestRecentKey(t *testing.T) {
+	b := []byte("0123456789abcdef")
+	k := recentKey("", "10.0.0.1", b)
+	if k != recentKey("", "10.0.0.1", []byte("0123456789abcdef")) {
+		t.Error("recentKey differs for the same submission")
+	}
+	for _, other := range []string{
+		recentKey("", "10.0.0.2", b),
+		recentKey("product", "10.0.0.1", b),
+		recentKey("", "10.0.0.1", []byte("0123456789abcdeF")),
+	} {
+		if other == k {
+			t.Errorf("recentKey collision: %s", k)
+		}
+	}
+}
+
+func TestFlaggedKey(t *testing.T) {
+	b := []byte("0123456789abcdef")
+	k := flaggedKey("", "0123456789abcdef", b)
+	if k != flaggedKey("", "0123456789abcdef", []byte("0123456789abcdef")) {
+		t.Error("flaggedKey differs for the same user and bytes")
+	}
+	for _, other := range []string{
+		flaggedKey("", "fedcba9876543210", b),
+		flaggedKey("product", "0123456789abcdef", b),
+		flaggedKey("", "0123456789abcdef", []byte("0123456789abcdeF")),
+		recentKey("", "0123456789abcdef", b),
+	} {
+		if other == k {
+			t.Errorf("flaggedKey collision: %s", k)
+		}
+	}
+}
+
+func TestFlaggedWarning(t *testing.T) {
+	f := flaggedSubmission{resultNotRandom, "Counting", 1500000000}
+	if got := flaggedWarning(f); got != "Already flagged (Counting) at 2017-07-14T02:40:00Z" {
+		t.Errorf("flaggedWarning() = %q", got)
+	}
+}
+
+func TestCacheableVerdict(t *testing.T) {
+	var tests = []struct {
+		result string
+		want   bool
+	}{
+		{resultNotRandom, true},
+		{resultNotUnique, true},
+		// A repeat must be checked for uniqueness again
+		{resultRandom, false},
+	}
+	for _, test := range tests {
+		if got := cacheableVerdict(test.result); got != test.want {
+			t.Errorf("cacheableVerdict(%s) = %v", test.result, got)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package randomsanity
+
+// Uniqueness database entries remember who submitted them (UserID and
+// Tag), so both users can be told about a match. Unregistering
+// doesn't touch those entries, so without cleanup a match against an
+// old entry would still be reported as a cross-user match. This cron
+// job (see cron.yaml) blanks UserID and Tag in entries whose user is
+// no longer registered.
+//
+// The database is too big to walk in one request, so each run stops
+// after reconcileRunTime and saves a cursor, and which namespace it
+// got to; the next run picks up where it left off (so namespaces later
+// in the list still get their turn) and starts over once every bucket
+// has been seen.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Cron requests get 10 minutes; leave time to save the cursors
+const reconcileRunTime = 8 * time.Minute
+
+// Where the last run stopped, one per namespace (key is the namespace)
+type ReconcileCursor struct {
+	Cursor string `datastore:",noindex"`
+}
+
+// The namespace the last run stopped in, so the next one starts there
+type ReconcileProgress struct {
+	Namespace string `datastore:",noindex"`
+}
+
+type ReconcileResult struct {
+	Buckets  int // RBH entities read
+	Cleared  int // Entries whose UserID and Tag were blanked
+	Finished int // Namespaces where every bucket has now been seen
+}
+
+// Blanks UserID and Tag in entries for users not in registered;
+// returns how many were changed
+func clearOrphans(hits []RngUniqueBytesEntry, registered map[string]bool) int {
+	n := 0
+	for i := range hits {
+		if len(hits[i].UserID) > 0 && !registered[hits[i].UserID] {
+			hits[i].UserID = ""
+			hits[i].Tag = ""
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the set of registered user IDs
+func registeredUsers(ctx appengine.Context) (map[string]bool, error) {
+	var regs []NotifyViaEmail
+	if _, err := datastore.NewQuery("NotifyViaEmail").GetAll(defaultNamespace(ctx), &regs); err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(regs))
+	for _, r := range regs {
+		result[r.UserID] = true
+	}
+	return result, nil
+}
+
+// Returns every namespace with entities in it, including "" (the
+// default namespace)
+func namespaces(ctx appengine.Context) ([]string, error) {
+	keys, err := datastore.NewQuery("__namespace__").KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(keys))
+	for i, k := range keys {
+		result[i] = k.StringID() // "" for the default namespace
+	}
+	return result, nil
+}
+
+// Returns all (in __namespace__ order) starting from namespace from,
+// and then the ones before it; if from is gone, starts at the next
+// one after it.
+func resumeOrder(all []string, from string) []string {
+	start := 0
+	for start < len(all) && all[start] < from {
+		start++
+	}
+	if start == len(all) {
+		start = 0
+	}
+	return append(append([]string(nil), all[start:]...), all[:start]...)
+}
+
+func reconcileProgressKey(ctx appengine.Context) *datastore.Key {
+	return datastore.NewKey(defaultNamespace(ctx), "ReconcileProgress", "progress", 0, nil)
+}
+
+func reconcileCursorKey(ctx appengine.Context, ns string) *datastore.Key {
+	ctx = defaultNamespace(ctx)
+	if len(ns) == 0 {
+		ns = "-" // Keys can't be empty
+	}
+	return datastore.NewKey(ctx, "ReconcileCursor", ns, 0, nil)
+}
+
+// Clears orphaned entries in one bucket; done in a transaction so a
+// concurrent write() isn't lost
+func reconcileBucket(ctx appengine.Context, key *datastore.Key, registered map[string]bool) (int, error) {
+	n := 0
+	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		hit := new(RngUniqueBytes)
+		if err := datastore.Get(ctx, key, hit); err != nil {
+			return err
+		}
+		n = clearOrphans(hit.Hits, registered)
+		if n == 0 {
+			return nil
+		}
+		_, err := datastore.Put(ctx, key, hit)
+		return err
+	}, nil)
+	return n, err
+}
+
+// Reconciles the buckets in ctx's namespace, starting from the saved
+// cursor, until deadline. Returns true if it reached the last bucket.
+func reconcileNamespace(ctx appengine.Context, registered map[string]bool, deadline time.Time, result *ReconcileResult) (bool, error) {
+	// Entries can hold hashed IDs, with this namespace's secret,
+	// whether or not Settings.HashIdentities is on now
+	secret, err := secretKey(ctx)
+	if err != nil {
+		return false, err
+	}
+	registered = storedUsers(secret, registered, true)
+	cursorKey := reconcileCursorKey(ctx, namespace(ctx))
+	var saved ReconcileCursor
+	if err := datastore.Get(defaultNamespace(ctx), cursorKey, &saved); err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	q := datastore.NewQuery("RBH")
+	if len(saved.Cursor) > 0 {
+		if c, err := datastore.DecodeCursor(saved.Cursor); err == nil {
+			q = q.Start(c)
+		}
+	}
+	it := q.Run(ctx)
+	finished := false
+	for time.Now().Before(deadline) {
+		var hit RngUniqueBytes
+		key, err := it.Next(&hit)
+		if err == datastore.Done {
+			finished = true
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		result.Buckets++
+		if clearOrphans(hit.Hits, registered) == 0 {
+			continue
+		}
+		n, err := reconcileBucket(ctx, key, registered)
+		if err != nil {
+			return false, err
+		}
+		result.Cleared += n
+	}
+	saved.Cursor = ""
+	if !finished {
+		c, err := it.Cursor()
+		if err != nil {
+			return false, err
+		}
+		saved.Cursor = c.String()
+	}
+	_, err = datastore.Put(defaultNamespace(ctx), cursorKey, &saved)
+	return finished, err
+}
+
+// Run by cron (see cron.yaml); returns a ReconcileResult as JSON.
+// Only admins (and cron) can call this (see app.yaml).
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	deadline := time.Now().Add(reconcileRunTime)
+
+	registered, err := registeredUsers(ctx)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	all, err := namespaces(ctx)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	var progress ReconcileProgress
+	if err := datastore.Get(ctx, reconcileProgressKey(ctx), &progress); err != nil && err != datastore.ErrNoSuchEntity {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	var result ReconcileResult
+	order := resumeOrder(all, progress.Namespace)
+	next := "" // Where the next run starts; the first namespace once all are done
+	for _, ns := range order {
+		if !time.Now().Before(deadline) {
+			next = ns
+			break
+		}
+		nsCtx, err := appengine.Namespace(ctx, ns)
+		if err != nil {
+			continue
+		}
+		finished, err := reconcileNamespace(nsCtx, registered, deadline, &result)
+		if err != nil {
+			sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+			return
+		}
+		if !finished {
+			next = ns
+			break
+		}
+		result.Finished++
+	}
+	progress.Namespace = next
+	if _, err := datastore.Put(ctx, reconcileProgressKey(ctx), &progress); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	ctx.Infof("Reconciled %d buckets, cleared %d entries", result.Buckets, result.Cleared)
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
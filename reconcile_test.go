@@ -0,0 +1,57 @@
+package randomsanity
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClearOrphans(t *testing.T) {
+	hits := []RngUniqueBytesEntry{
+		{Trailing: []byte{1}, UserID: "gone", Tag: "prod"},
+		{Trailing: []byte{2}, UserID: "still", Tag: "staging"},
+		{Trailing: []byte{3}},
+		{Trailing: []byte{4}, UserID: "gone"},
+	}
+	registered := map[string]bool{"still": true}
+	if n := clearOrphans(hits, registered); n != 2 {
+		t.Errorf("clearOrphans() = %d, want 2", n)
+	}
+	want := []RngUniqueBytesEntry{
+		{Trailing: []byte{1}},
+		{Trailing: []byte{2}, UserID: "still", Tag: "staging"},
+		{Trailing: []byte{3}},
+		{Trailing: []byte{4}},
+	}
+	for i := range hits {
+		if hits[i].UserID != want[i].UserID || hits[i].Tag != want[i].Tag || hits[i].Trailing[0] != want[i].Trailing[0] {
+			t.Errorf("entry %d = %+v, want %+v", i, hits[i], want[i])
+		}
+	}
+	// Nothing left to clear
+	if n := clearOrphans(hits, registered); n != 0 {
+		t.Errorf("clearOrphans() again = %d, want 0", n)
+	}
+}
+
+func TestResumeOrder(t *testing.T) {
+	all := []string{"", "alpha", "beta", "gamma"}
+	var tests = []struct {
+		from string
+		want []string
+	}{
+		{"", []string{"", "alpha", "beta", "gamma"}},
+		{"beta", []string{"beta", "gamma", "", "alpha"}},
+		{"gamma", []string{"gamma", "", "alpha", "beta"}},
+		{"b", []string{"beta", "gamma", "", "alpha"}}, // Deleted since the last run
+		{"zeta", []string{"", "alpha", "beta", "gamma"}},
+	}
+	for _, test := range tests {
+		got := resumeOrder(all, test.from)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("resumeOrder(%q) = %q, want %q", test.from, got, test.want)
+		}
+	}
+	if len(resumeOrder(nil, "beta")) != 0 {
+		t.Error("resumeOrder(nil) not empty")
+	}
+}
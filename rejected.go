@@ -0,0 +1,43 @@
+package randomsanity
+
+// Submissions rejected before they're checked (bad hex, too short, ...)
+// would otherwise leave no trace, so a client systematically sending
+// garbage would go unnoticed. Each category has a usage counter (see
+// /v1/usage), and rejections can be logged too.
+//
+// Rejections are counted in the default namespace whatever ns=... the
+// client passed, and without an appengine.Context: they go straight in
+// the usage buffer and are written by the next flush (see usage.go).
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Usage counter for each error code that means a malformed submission
+var rejectionCounters = map[string]string{
+	"invalid_hex":            "Rejected_InvalidHex",
+	"invalid_base64":         "Rejected_InvalidBase64",
+	"too_short":              "Rejected_TooShort",
+	"too_large":              "Rejected_TooLarge",
+	"unsupported_media_type": "Rejected_UnsupportedMediaType",
+}
+
+// Set to true to also log each rejection (as key="value" pairs, like
+// logVerdict). Off by default: garbage traffic can be a lot of lines.
+const logRejections = false
+
+// Counts (and maybe logs) a submission rejected with error code
+func recordRejection(r *http.Request, code string) {
+	k, ok := rejectionCounters[code]
+	if !ok {
+		return
+	}
+	pendingUsage.add(usageKey{"", k}, 1, time.Now())
+	if logRejections {
+		log.Printf("Submission rejected code=%s path=%s ip=%s", strconv.Quote(code),
+			strconv.Quote(r.URL.Path), strconv.Quote(clientIP(r, trustedProxies)))
+	}
+}
@@ -0,0 +1,46 @@
+package randomsanity
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordRejection(t *testing.T) {
+	var tests = []struct {
+		method      string
+		path        string
+		contentType string
+		body        []byte
+		handler     http.HandlerFunc
+		counter     string // "" for none
+	}{
+		{"GET", "/v1/q/xyz", "", nil, submitBytesHandler, "Rejected_InvalidHex"},
+		{"POST", "/v1/q", "text/plain", []byte("0g"), submitBytesHandler, "Rejected_InvalidHex"},
+		{"GET", "/v1/q/0011", "", nil, submitBytesHandler, "Rejected_TooShort"},
+		{"POST", "/v1/q", "application/octet-stream", make([]byte, maxInputBytes+1), submitBytesHandler, "Rejected_TooLarge"},
+		{"POST", "/v1/q", "application/xml", nil, submitBytesHandler, "Rejected_UnsupportedMediaType"},
+		{"POST", "/v1/stream", "text/plain", nil, streamHandler, "Rejected_UnsupportedMediaType"},
+		{"GET", "/v1/q/00/00", "", nil, submitBytesHandler, ""},
+	}
+	for _, test := range tests {
+		pendingUsage.take(time.Now())
+		r := httptest.NewRequest(test.method, test.path, bytes.NewReader(test.body))
+		if len(test.contentType) > 0 {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		test.handler(httptest.NewRecorder(), r)
+		counts := pendingUsage.take(time.Now())
+		if len(test.counter) == 0 {
+			if len(counts) != 0 {
+				t.Errorf("%s %s counted %v", test.method, test.path, counts)
+			}
+			continue
+		}
+		if n := counts[usageKey{"", test.counter}]; n != 1 || len(counts) != 1 {
+			t.Errorf("%s %s (%s) counted %v, want %s once", test.method, test.path, test.contentType, counts, test.counter)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package randomsanity
+
+// Replay a corpus of known-good and known-bad byte arrays through
+// LooksRandom, to check a deployment's tests behave as expected.
+// Nothing is stored and the uniqueness database is not consulted.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type testVector struct {
+	Hex    string `json:"hex"`
+	Random bool   `json:"random"`           // Expected result
+	Reason string `json:"reason,omitempty"` // Why LooksRandom said false, or why Hex is invalid
+}
+
+// Returns the vectors that LooksRandom disagrees with.
+// Like randomsanitystat_test.go, spaces in Hex are ignored.
+func replay(vectors []testVector) []testVector {
+	disagree := []testVector{}
+	for _, v := range vectors {
+		b, err := hex.DecodeString(strings.Replace(v.Hex, " ", "", -1))
+		if err != nil {
+			v.Reason = "Invalid hex"
+			disagree = append(disagree, v)
+			continue
+		}
+		if got, reason := LooksRandom(b); got != v.Random {
+			v.Reason = reason
+			disagree = append(disagree, v)
+		}
+	}
+	return disagree
+}
+
+// POST a JSON array of {"hex": "...", "random": true/false}; the
+// response is the array of vectors that got a different result.
+// Only admins can call this (see app.yaml).
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "replay method must be POST")
+		return
+	}
+	var vectors []testVector
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&vectors); err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(replay(vectors))
+}
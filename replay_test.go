@@ -0,0 +1,29 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	vectors := []testVector{
+		{Hex: "01 02 03 04 05 06 07 08 09", Random: false},
+		{Hex: "e47d253e45ccfa65f44493677aaf56ae", Random: true},
+		{Hex: "000000000000000000", Random: true},                        // Wrong, Repeated bytes
+		{Hex: "be5d96f4a70273c960b3ce27997d6e388aac5e6b", Random: false}, // Wrong, is random
+		{Hex: "xyz", Random: true},
+	}
+	got := replay(vectors)
+	want := []testVector{
+		{Hex: "000000000000000000", Random: true, Reason: "Repeated bytes"},
+		{Hex: "be5d96f4a70273c960b3ce27997d6e388aac5e6b", Random: false},
+		{Hex: "xyz", Random: true, Reason: "Invalid hex"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("replay() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("replay()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
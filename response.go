@@ -0,0 +1,99 @@
+package randomsanity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A checked submission gets a 200 response with body "true" or "false"
+// and an X-Result header saying why, so programs don't have to guess:
+// "random" (passed every test), "not_random" (failed a statistical
+// test) or "not_unique" (seen before). Resubmitting the same bytes
+// won't change a not_random or not_unique result. Clients should only
+// retry errors: 429 rate_limited (after the number of seconds in the
+// Retry-After header) and 5xx.
+const (
+	resultRandom    = "random"
+	resultNotRandom = "not_random"
+	resultNotUnique = "not_unique"
+)
+
+// Cache-Control for verdicts, which are only true for the moment they
+// were sent (the same bytes are not_unique the second time), and for
+// read-only endpoints (see sendCachedJSON), which proxies may cache.
+const (
+	resultCacheControl   = "no-store"
+	readOnlyCacheControl = "max-age=60"
+)
+
+func sendResult(w http.ResponseWriter, result string) {
+	w.Header().Set("Cache-Control", resultCacheControl)
+	w.Header().Set("X-Result", result)
+	fmt.Fprint(w, result == resultRandom)
+}
+
+// Tell the client to wait (up to timespan) before trying again
+func sendRateLimited(w http.ResponseWriter, r *http.Request, timespan time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(timespan/time.Second)))
+	sendError(w, r, http.StatusTooManyRequests, "rate_limited", "Request limit exceeded")
+}
+
+// Errors are sent as JSON, for example
+// {"error": "Invalid hex", "code": "invalid_hex"}.
+// code is stable and meant for programs; error is meant for people
+// and might change, or be translated (see locale.go). Clients that
+// accept text/plain but not JSON get just the error message, as
+// plain text.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func sendError(w http.ResponseWriter, r *http.Request, status int, code string, msg string) {
+	msg = localize(w, r, msg)
+	if wantsText(r) {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(errorResponse{msg, code})
+}
+
+// Sends v as JSON with an ETag (a hash of the JSON), or just
+// 304 Not Modified if the client already has that version
+// (If-None-Match). For read-only endpoints dashboards poll.
+func sendCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "internal_error", "JSON encoding error")
+		return
+	}
+	h := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(h[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", readOnlyCacheControl)
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// Returns true if the client asked for text/plain and not JSON
+func wantsText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
@@ -0,0 +1,143 @@
+package randomsanity
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/q/00", nil)
+	w := httptest.NewRecorder()
+	sendError(w, r, http.StatusBadRequest, "invalid_hex", "Invalid hex")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	var e errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || e.Error != "Invalid hex" || e.Code != "invalid_hex" {
+		t.Errorf("body = %s", w.Body.String())
+	}
+
+	// Plain text only if asked for:
+	r.Header.Set("Accept", "text/plain")
+	w = httptest.NewRecorder()
+	sendError(w, r, http.StatusBadRequest, "invalid_hex", "Invalid hex")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "Invalid hex" {
+		t.Errorf("body = %s", body)
+	}
+	r.Header.Set("Accept", "application/json, text/plain")
+	if wantsText(r) {
+		t.Errorf("wantsText(%s) = true", r.Header.Get("Accept"))
+	}
+}
+
+// Failures that are detected before any datastore or memcache access
+func TestErrorCodes(t *testing.T) {
+	var tests = []struct {
+		method  string
+		path    string
+		ua      string
+		handler http.HandlerFunc
+		status  int
+		code    string
+	}{
+		{"GET", "/v1/q/00/00", "", submitBytesHandler, http.StatusBadRequest, "invalid_request"},
+		{"GET", "/v1/q/xyz", "", submitBytesHandler, http.StatusBadRequest, "invalid_hex"},
+		{"GET", "/v1/q/0011", "", submitBytesHandler, http.StatusBadRequest, "too_short"},
+		{"GET", "/v1/registeremail/a@example.com", "Mozilla", registerEmailHandler, http.StatusForbidden, "curl_required"},
+		{"GET", "/v1/registeremail/", "curl/7.0", registerEmailHandler, http.StatusBadRequest, "invalid_email"},
+		{"GET", "/v1/registeremail/a/b", "curl/7.0", registerEmailHandler, http.StatusBadRequest, "path_too_long"},
+		{"GET", "/v1/unregister/0123", "", unRegisterIDHandler, http.StatusBadRequest, "method_not_allowed"},
+		{"DELETE", "/v1/unregister/0123/4", "", unRegisterIDHandler, http.StatusBadRequest, "path_too_long"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("User-Agent", test.ua)
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+		var e errorResponse
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != test.status || e.Code != test.code {
+			t.Errorf("%s %s = %d %q, want %d %q", test.method, test.path, w.Code, e.Code, test.status, test.code)
+		}
+	}
+}
+
+func TestResultCodes(t *testing.T) {
+	var tests = []struct {
+		result string
+		body   string
+	}{
+		{resultRandom, "true"},
+		{resultNotRandom, "false"},
+		{resultNotUnique, "false"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		sendResult(w, test.result)
+		if w.Code != http.StatusOK || w.Body.String() != test.body || w.Header().Get("X-Result") != test.result {
+			t.Errorf("sendResult(%s): %d %q X-Result=%q", test.result, w.Code, w.Body.String(), w.Header().Get("X-Result"))
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("sendResult(%s): Cache-Control=%q", test.result, cc)
+		}
+	}
+
+	// Rate limited is an error, with a hint about when to retry
+	r := httptest.NewRequest("GET", "/v1/q/00", nil)
+	w := httptest.NewRecorder()
+	sendRateLimited(w, r, time.Hour)
+	var e errorResponse
+	json.Unmarshal(w.Body.Bytes(), &e)
+	if w.Code != http.StatusTooManyRequests || e.Code != "rate_limited" || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("sendRateLimited: %d %s Retry-After=%q", w.Code, w.Body.String(), w.Header().Get("Retry-After"))
+	}
+	if w.Header().Get("X-Result") != "" {
+		t.Errorf("sendRateLimited set X-Result")
+	}
+}
+
+func TestSendCachedJSON(t *testing.T) {
+	get := func(v interface{}, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/v1/usage", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		sendCachedJSON(w, r, v)
+		return w
+	}
+	usage := map[string]int64{"Success": 10, "Fail_Counting": 1}
+	w := get(usage, "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || strings.TrimSpace(w.Body.String()) != `{"Fail_Counting":1,"Success":10}` {
+		t.Fatalf("first GET: %d ETag=%q %s", w.Code, etag, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "no-store") {
+		t.Errorf("first GET: Cache-Control=%q", cc)
+	}
+
+	// Same data: 304, no body
+	for _, inm := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		w = get(usage, inm)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: %d %s", inm, w.Code, w.Body.String())
+		}
+	}
+
+	// Changed data: new ETag, 200
+	usage["Success"]++
+	w = get(usage, etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after change: %d ETag=%q", w.Code, w.Header().Get("ETag"))
+	}
+}
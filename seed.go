@@ -0,0 +1,85 @@
+package randomsanity
+
+// Preload known-bad values (for example, keys from published
+// weak-RNG incidents) into the uniqueness database, so anybody
+// who submits one of them is told it is not unique. They're stored in
+// the default namespace, and looked up there for clients in other
+// namespaces and orgs too (see seededMatch).
+
+import (
+	"appengine"
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tag stored with seeded entries
+const seedTag = "Known bad value"
+
+// POST one hex value per line. Only admins can call this (see app.yaml).
+func seedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "seed method must be POST")
+		return
+	}
+	if uniquenessMode != uniqueReadWrite {
+		sendError(w, r, http.StatusForbidden, "read_only", "Uniqueness database is not writable")
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+
+	// Check everything before writing anything:
+	var values [][]byte
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, 1<<20))
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			sendError(w, r, http.StatusBadRequest, "invalid_hex", fmt.Sprintf("Invalid hex on line %d", line))
+			return
+		}
+		if len(b) < 16 {
+			sendError(w, r, http.StatusBadRequest, "too_short", fmt.Sprintf("Line %d: must provide 16 or more bytes", line))
+			return
+		}
+		if len(b) > 64 {
+			b = b[0:64] // Same limit as submitBytesHandler
+		}
+		values = append(values, b)
+	}
+	if err := scanner.Err(); err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_request", "Error reading request")
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	secret, err := secretKey(ctx)
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	maxEntriesPerKey := getSettings(ctx).MaxEntriesPerKey
+	for n, b := range values {
+		for _, chunk := range seedChunks(secret, b) {
+			err := write(ctx, chunk, time.Now().Unix(), "", seedTag, maxEntriesPerKey)
+			if err != nil {
+				sendError(w, r, http.StatusInternalServerError, "datastore_error", fmt.Sprintf("Datastore error, %d values seeded", n))
+				return
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d values seeded\n", len(values))
+}
+
+// Returns the hashes to store for b: every window (not just the first
+// and last, like unique() stores) so a submission overlapping any part
+// of a known-bad value is caught, whatever Settings.UniqueWindowStep is.
+func seedChunks(secret []byte, b []byte) [][]byte {
+	return windowChunks(secret, b, windowOffsets(len(b), 1))
+}
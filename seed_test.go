@@ -0,0 +1,90 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+// A seeded value, and any submission overlapping it by a window, is
+// then looked up as not unique
+func TestSeedChunks(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	bad := make([]byte, 48)
+	for i := range bad {
+		bad[i] = byte(i*37 + 11)
+	}
+	// What write() would leave in the database
+	buckets := make(map[int64]*RngUniqueBytes)
+	seeded := seedChunks(secret, bad)
+	if len(seeded) != len(bad)-15 {
+		t.Fatalf("seedChunks() = %d chunks, want every window (%d)", len(seeded), len(bad)-15)
+	}
+	for _, chunk := range seeded {
+		hit, ok := buckets[bucketID(chunk)]
+		if !ok {
+			hit = new(RngUniqueBytes)
+			buckets[bucketID(chunk)] = hit
+		}
+		hit.Hits = append(hit.Hits, RngUniqueBytesEntry{Trailing: chunk[prefixBytes:], Tag: seedTag})
+	}
+	lookup := func(b []byte, step int) (*RngUniqueBytesEntry, bool) {
+		chunks := windowChunks(secret, b, windowOffsets(len(b), step))
+		vals := make([]*RngUniqueBytes, len(chunks))
+		for i, chunk := range chunks {
+			vals[i] = new(RngUniqueBytes)
+			if hit, ok := buckets[bucketID(chunk)]; ok {
+				vals[i] = hit
+			}
+		}
+		found, first := matchWindows(chunks, vals)
+		if first < 0 {
+			return nil, false
+		}
+		return found[first], true
+	}
+
+	other := make([]byte, 64)
+	for i := range other {
+		other[i] = byte(i*91 + 3)
+	}
+	var tests = []struct {
+		name string
+		b    []byte
+		step int
+		want bool
+	}{
+		{"the seeded value", bad, 1, true},
+		{"its middle 16 bytes", bad[17:33], 1, true},
+		{"it, after other bytes", append(append([]byte{}, other[:37]...), bad...), 16, true},
+		{"other bytes", other, 1, false},
+	}
+	for _, test := range tests {
+		e, ok := lookup(test.b, test.step)
+		if ok != test.want {
+			t.Errorf("%s: matched = %v", test.name, ok)
+			continue
+		}
+		if ok && e.Tag != seedTag {
+			t.Errorf("%s: matched tag %q", test.name, e.Tag)
+		}
+	}
+	if reason, _ := matchReport(&uniqueMatch{Entry: RngUniqueBytesEntry{Tag: seedTag}}); reason != "Non Unique" {
+		t.Errorf("reason = %q", reason)
+	}
+}
+
+// Other namespaces only match what seedHandler stored in the default
+// one, not other clients' submissions
+func TestSeededHits(t *testing.T) {
+	hits := []RngUniqueBytesEntry{
+		{Trailing: []byte{1}, Tag: seedTag},
+		{Trailing: []byte{2}, UserID: "someone", Tag: seedTag},
+		{Trailing: []byte{3}, Tag: "prod"},
+		{Trailing: []byte{4}},
+	}
+	if got := seededHits(hits); len(got) != 1 || got[0].Trailing[0] != 1 {
+		t.Errorf("seededHits() = %v", got)
+	}
+	if got := seededHits(nil); len(got) != 0 {
+		t.Errorf("seededHits(nil) = %v", got)
+	}
+}
@@ -0,0 +1,162 @@
+package randomsanity
+
+// Check a deployment end to end: the statistical tests, datastore,
+// memcache, the uniqueness database and notification emails (built,
+// not sent). Unlike /v1/replay, this touches every backend a
+// submission does; uniqueness entries go in their own namespace so
+// real users' entries aren't affected.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Namespace the uniqueness check writes to
+const selfTestNamespace = "selftest"
+
+type SelfTestStage struct {
+	Name  string
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+type SelfTestReport struct {
+	OK     bool // true if every stage was
+	Stages []SelfTestStage
+}
+
+type selfTestStep struct {
+	name string
+	run  func(ctx appengine.Context) error
+}
+
+var selfTestSteps = []selfTestStep{
+	{"LooksRandom", selfTestLooksRandom},
+	{"Datastore", selfTestDatastore},
+	{"Memcache", selfTestMemcache},
+	{"Uniqueness", selfTestUniqueness},
+	{"Notification", selfTestNotification},
+}
+
+// Runs every step, even after one fails, so the report shows
+// everything that's broken
+func runSelfTest(ctx appengine.Context, steps []selfTestStep) SelfTestReport {
+	report := SelfTestReport{OK: true, Stages: []SelfTestStage{}}
+	for _, step := range steps {
+		stage := SelfTestStage{Name: step.name, OK: true}
+		if err := step.run(ctx); err != nil {
+			stage.OK, stage.Error = false, err.Error()
+			report.OK = false
+		}
+		report.Stages = append(report.Stages, stage)
+	}
+	return report
+}
+
+func selfTestLooksRandom(ctx appengine.Context) error {
+	bad := make([]byte, 32) // Zeros
+	if ok, _ := LooksRandom(bad); ok {
+		return errors.New("zeros passed")
+	}
+	good := make([]byte, 32)
+	if _, err := rand.Read(good); err != nil {
+		return err
+	}
+	// 1-in-2^60 chance of this being a false alarm
+	if ok, reason := LooksRandom(good); !ok {
+		return fmt.Errorf("random bytes failed (%s)", reason)
+	}
+	return nil
+}
+
+func selfTestDatastore(ctx appengine.Context) error {
+	ctx = defaultNamespace(ctx)
+	var s Settings
+	err := datastore.Get(ctx, settingsKey(ctx), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+func selfTestMemcache(ctx appengine.Context) error {
+	var b [8]byte
+	rand.Read(b[:])
+	item := &memcache.Item{Key: "selftest", Value: b[:], Expiration: time.Minute}
+	if err := memcache.Set(ctx, item); err != nil {
+		return err
+	}
+	got, err := memcache.Get(ctx, "selftest")
+	if err != nil {
+		return err
+	}
+	if string(got.Value) != string(b[:]) {
+		return errors.New("read back a different value")
+	}
+	return nil
+}
+
+// New random bytes should be unique; once stored, they shouldn't be
+func selfTestUniqueness(ctx appengine.Context) error {
+	if uniquenessMode != uniqueReadWrite {
+		return nil // Nothing can be stored; nothing to check
+	}
+	ctx, err := appengine.Namespace(ctx, selfTestNamespace)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	settings := getSettings(ctx)
+	if match, err := unique(ctx, b, "", "", settings); err != nil {
+		return err
+	} else if match != nil {
+		return errors.New("new random bytes were not unique")
+	}
+	// unique() might not have stored them (see Settings.UniqueWriteSampling)
+	secret, err := secretKey(ctx)
+	if err != nil {
+		return err
+	}
+	if err := write(ctx, hash16(secret, b), time.Now().Unix(), "", "", settings.MaxEntriesPerKey); err != nil {
+		return err
+	}
+	if match, err := unique(ctx, b, "", "", settings); err != nil {
+		return err
+	} else if match == nil {
+		return errors.New("stored bytes were still unique")
+	}
+	return nil
+}
+
+// Builds a notification email without sending it
+func selfTestNotification(ctx appengine.Context) error {
+	f := failure{Tag: "selftest", Bytes: make([]byte, 16), Reason: "Selftest"}
+	body := failureEmailBody(namespace(ctx), f)
+	if !strings.Contains(body, "Failure reason: Selftest") {
+		return errors.New("email body is missing the reason")
+	}
+	return nil
+}
+
+// GET returns a SelfTestReport as JSON, with status 500 if any stage
+// failed. Only admins can call this (see app.yaml).
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	report := runSelfTest(ctx, selfTestSteps)
+	w.Header().Add("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(report)
+}
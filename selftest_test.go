@@ -0,0 +1,36 @@
+package randomsanity
+
+import (
+	"appengine"
+	"errors"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	healthy := func(ctx appengine.Context) error { return nil }
+	broken := func(ctx appengine.Context) error { return errors.New("memcache unavailable") }
+
+	report := runSelfTest(nil, []selfTestStep{{"A", healthy}, {"B", healthy}})
+	if !report.OK || len(report.Stages) != 2 || !report.Stages[0].OK || !report.Stages[1].OK {
+		t.Errorf("healthy: %+v", report)
+	}
+
+	// Every stage runs, and the broken one says why
+	report = runSelfTest(nil, []selfTestStep{{"A", healthy}, {"Memcache", broken}, {"C", healthy}})
+	if report.OK || len(report.Stages) != 3 {
+		t.Fatalf("broken: %+v", report)
+	}
+	if s := report.Stages[1]; s.Name != "Memcache" || s.OK || s.Error != "memcache unavailable" {
+		t.Errorf("broken stage: %+v", s)
+	}
+	if !report.Stages[0].OK || !report.Stages[2].OK {
+		t.Errorf("healthy stages: %+v", report.Stages)
+	}
+}
+
+// The stages that don't need App Engine
+func TestSelfTestStages(t *testing.T) {
+	if err := selfTestLooksRandom(nil); err != nil {
+		t.Errorf("selfTestLooksRandom: %v", err)
+	}
+}
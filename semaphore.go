@@ -0,0 +1,39 @@
+package randomsanity
+
+// Each uniqueness check is a GetMulti of up to 49 keys plus a couple
+// of transactions; a burst of requests can swamp the datastore. At
+// most maxUniqueChecks run at once per instance; the rest wait up to
+// uniqueCheckWait and then skip the uniqueness check (the statistical
+// tests still run).
+
+import (
+	"time"
+)
+
+const maxUniqueChecks = 20
+const uniqueCheckWait = 2 * time.Second
+
+type semaphore chan struct{}
+
+// Returns false if no slot came free within timeout
+func (s semaphore) acquire(timeout time.Duration) bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+var uniqueCheckSlots = make(semaphore, maxUniqueChecks)
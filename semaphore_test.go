@@ -0,0 +1,54 @@
+package randomsanity
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	const slots = 3
+	s := make(semaphore, slots)
+
+	// Never more than slots holders at once
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !s.acquire(time.Minute) {
+				t.Error("acquire timed out")
+				return
+			}
+			mu.Lock()
+			inFlight++
+			if inFlight > most {
+				most = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			s.release()
+		}()
+	}
+	wg.Wait()
+	if most > slots {
+		t.Errorf("%d holders at once, want at most %d", most, slots)
+	}
+
+	// Full: times out instead of waiting forever
+	for i := 0; i < slots; i++ {
+		s.acquire(0)
+	}
+	if s.acquire(10 * time.Millisecond) {
+		t.Error("acquire succeeded with no free slots")
+	}
+	s.release()
+	if !s.acquire(0) {
+		t.Error("acquire failed after release")
+	}
+}
@@ -0,0 +1,112 @@
+package randomsanity
+
+// Our own monitoring shouldn't use up rate limits, but probes come
+// from all over, so allowlisting addresses doesn't work. Instead they
+// send an X-Service-Token header: "<unix time>:<hex HMAC-SHA256 of
+// the time>" under a server secret, which admins can get from
+// /v1/servicesecret. Tokens are good for serviceTokenMaxAge either
+// side of the time in them, so a captured token can't be used for long.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serviceTokenMaxAge = 5 * time.Minute
+
+type ServiceSecret struct {
+	Secret []byte `datastore:",noindex"`
+}
+
+// Like secretKey, kept in memory once loaded
+var serviceSecretCache struct {
+	sync.Mutex
+	secret []byte
+}
+
+func serviceSecret(ctx appengine.Context) ([]byte, error) {
+	serviceSecretCache.Lock()
+	defer serviceSecretCache.Unlock()
+	if serviceSecretCache.secret != nil {
+		return serviceSecretCache.secret, nil
+	}
+	ctx = defaultNamespace(ctx)
+	key := datastore.NewKey(ctx, "ServiceSecret", "secret", 0, nil)
+	var s ServiceSecret
+	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+		err := datastore.Get(ctx, key, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Secret = make([]byte, 32)
+		if _, err := rand.Read(s.Secret); err != nil {
+			return err
+		}
+		_, err = datastore.Put(ctx, key, &s)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	serviceSecretCache.secret = s.Secret
+	return s.Secret, nil
+}
+
+// Returns a service token for time t
+func serviceToken(secret []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	return ts + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if token was made with secret, within serviceTokenMaxAge of now
+func validServiceToken(secret []byte, token string, now time.Time) bool {
+	parts := strings.Split(token, ":")
+	if len(parts) != 2 {
+		return false
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > serviceTokenMaxAge || age < -serviceTokenMaxAge {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(serviceToken(secret, time.Unix(ts, 0))))
+}
+
+// Returns true if r has a valid X-Service-Token header
+func serviceRequest(ctx appengine.Context, r *http.Request) bool {
+	token := r.Header.Get("X-Service-Token")
+	if len(token) == 0 {
+		return false
+	}
+	secret, err := serviceSecret(ctx)
+	if err != nil {
+		return false
+	}
+	return validServiceToken(secret, token, time.Now())
+}
+
+// Only admins can call this (see app.yaml)
+func serviceSecretHandler(w http.ResponseWriter, r *http.Request) {
+	secret, err := serviceSecret(appengine.NewContext(r))
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%s\n", hex.EncodeToString(secret))
+}
@@ -0,0 +1,40 @@
+package randomsanity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1500000000, 0)
+	token := serviceToken(secret, now)
+	forged := token[:len(token)-1] + "0"
+	if forged == token {
+		forged = token[:len(token)-1] + "1"
+	}
+
+	var tests = []struct {
+		name  string
+		token string
+		now   time.Time
+		want  bool
+	}{
+		{"valid", token, now, true},
+		{"a bit old", token, now.Add(serviceTokenMaxAge), true},
+		{"clock skew", token, now.Add(-time.Minute), true},
+		{"expired", token, now.Add(serviceTokenMaxAge + time.Second), false},
+		{"from the future", token, now.Add(-serviceTokenMaxAge - time.Second), false},
+		{"other secret", serviceToken([]byte("not the server secret"), now), now, false},
+		{"changed time", "1500000001" + token[len("1500000000"):], now, false},
+		{"changed mac", forged, now, false},
+		{"no mac", "1500000000", now, false},
+		{"empty", "", now, false},
+		{"garbage", "a:b", now, false},
+	}
+	for _, test := range tests {
+		if got := validServiceToken(secret, test.token, test.now); got != test.want {
+			t.Errorf("%s: validServiceToken(%q) = %v", test.name, test.token, got)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package randomsanity
+
+// Limits operators might want to tune for their traffic, without
+// redeploying. They're stored in one datastore entity (in the default
+// namespace, shared by all namespaces) and cached in memcache, and
+// each instance keeps the ones it last read (see getSettings).
+//
+// That includes the false-positive budget (see fpBits and
+// budget.go): every handler refreshes the settings before it runs
+// (see handleFunc), so the detectors always use the current one.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Settings struct {
+	RateLimit           int64 `datastore:",noindex"` // Submissions per IP address per hour
+	RegisteredRateLimit int64 `datastore:",noindex"` // ... if the submitter is registered
+	TagRateLimit        int64 `datastore:",noindex"` // ... for each of a registered user's tags (see taglimit.go)
+	StreamRateLimit     int64 `datastore:",noindex"` // Samples per IP address per hour at /v1/stream
+	MaxEntriesPerKey    int64 `datastore:",noindex"` // Uniqueness database bucket size
+	// Store only about 1 in UniqueWriteSampling new values in the
+	// uniqueness database, to bound its growth. Every submission is
+	// still looked up, but two clients producing the same bytes are
+	// only caught if the first one's bytes were stored, so this also
+	// divides the chance of catching them.
+	UniqueWriteSampling int64 `datastore:",noindex"`
+	// Look up every UniqueWindowStep'th 16-byte window of inputs
+	// longer than smallUniqueInput, instead of every one (see
+	// windowOffsets). Fewer datastore reads, but an earlier
+	// submission is only found if it overlaps at a multiple of the step.
+	UniqueWindowStep int64 `datastore:",noindex"`
+	// Also look up the byte-reversed windows, to catch a client that
+	// reverses its bytes matching one that doesn't. Doubles the
+	// datastore reads per submission.
+	UniqueCheckReversed bool `datastore:",noindex"`
+	// Each test's false positive rate is 1-in-2^FalsePositiveBits
+	// (see fpBits); higher means fewer false positives, but more
+	// bytes needed for the tests to run.
+	FalsePositiveBits int64 `datastore:",noindex"`
+	// Look up at most this many windows per submission (see
+	// uniqueOffsets), whatever the input length and window step, to
+	// bound each request's datastore reads; the default is every
+	// window of 64 bytes. UniqueCheckReversed doubles it.
+	MaxUniqueWindows int64 `datastore:",noindex"`
+	// Reject submissions with more windows than that, instead of
+	// looking up only some of them (with an X-Warning).
+	RejectExcessWindows bool `datastore:",noindex"`
+	// Store salted hashes of user IDs and tags in the uniqueness
+	// database instead of the values (see identity.go) ...
+	HashIdentities bool `datastore:",noindex"`
+	// ... and a table to look them up, so the earlier submitter of a
+	// match can still be told about it
+	KeepIdentityLookup bool `datastore:",noindex"`
+}
+
+// Used until an admin changes them
+var defaultSettings = Settings{
+	RateLimit:           60,
+	RegisteredRateLimit: 600,
+	TagRateLimit:        200,
+	StreamRateLimit:     60,
+	MaxEntriesPerKey:    100,
+	UniqueWriteSampling: 1,
+	UniqueWindowStep:    1,
+	UniqueCheckReversed: false,
+	FalsePositiveBits:   defaultFalsePositiveBits,
+	MaxUniqueWindows:    64 - 16 + 1,
+	RejectExcessWindows: false,
+	HashIdentities:      false,
+	KeepIdentityLookup:  false,
+}
+
+const settingsCacheExpiration = 5 * time.Minute
+
+func settingsKey(ctx appengine.Context) *datastore.Key {
+	return datastore.NewKey(ctx, "Settings", "settings", 0, nil)
+}
+
+// How long an instance uses the settings it read before reading them
+// again, so most requests don't need a memcache round trip. A change
+// on another instance can take this long to be seen here.
+const settingsRefresh = time.Minute
+
+// The settings this instance last read
+var settingsCache struct {
+	sync.Mutex
+	s    Settings
+	read time.Time // Zero until the first successful read
+}
+
+// Returns the current settings, and makes their false-positive budget
+// the one the detectors use. If they can't be read, returns the ones
+// this instance last read (defaultSettings if it never has).
+func getSettings(ctx appengine.Context) Settings {
+	settingsCache.Lock()
+	s, read := settingsCache.s, settingsCache.read
+	settingsCache.Unlock()
+	if !read.IsZero() && time.Since(read) < settingsRefresh {
+		return s
+	}
+	fresh, err := readSettings(ctx)
+	if err != nil {
+		ctx.Warningf("Reading settings: %v", err)
+		if read.IsZero() {
+			return defaultSettings
+		}
+		return s // Try again next time
+	}
+	cacheSettings(fresh)
+	return fresh
+}
+
+// Makes s this instance's settings, and its budget the detectors'
+func cacheSettings(s Settings) {
+	settingsCache.Lock()
+	defer settingsCache.Unlock()
+	settingsCache.s = s
+	settingsCache.read = time.Now()
+	setFalsePositiveBits(int(s.FalsePositiveBits))
+}
+
+// Reads the settings from memcache or the datastore; defaultSettings
+// if an admin never changed them.
+func readSettings(ctx appengine.Context) (Settings, error) {
+	ctx = defaultNamespace(ctx)
+	s := defaultSettings // Also fills in fields added since s was saved
+	if _, err := memcache.JSON.Get(ctx, "settings", &s); err == nil {
+		return s, nil
+	}
+	s = defaultSettings
+	err := datastore.Get(ctx, settingsKey(ctx), &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return s, err
+	}
+	memcache.JSON.Set(ctx, &memcache.Item{Key: "settings", Object: s, Expiration: settingsCacheExpiration})
+	return s, nil
+}
+
+// Stores s as the current settings
+func saveSettings(ctx appengine.Context, s Settings) error {
+	ctx = defaultNamespace(ctx)
+	if _, err := datastore.Put(ctx, settingsKey(ctx), &s); err != nil {
+		return err
+	}
+	// So the next request reads the new settings
+	memcache.Delete(ctx, "settings")
+	cacheSettings(s)
+	return nil
+}
+
+// Returns s with any fields in form changed; every value must be a
+// positive integer, or true or false for the on/off settings, and
+// false_positive_bits must be in range (see fpBits).
+func (s Settings) update(form url.Values) (Settings, error) {
+	fields := []struct {
+		name string
+		v    *int64
+	}{
+		{"rate_limit", &s.RateLimit},
+		{"registered_rate_limit", &s.RegisteredRateLimit},
+		{"tag_rate_limit", &s.TagRateLimit},
+		{"stream_rate_limit", &s.StreamRateLimit},
+		{"max_entries_per_key", &s.MaxEntriesPerKey},
+		{"unique_write_sampling", &s.UniqueWriteSampling},
+		{"unique_window_step", &s.UniqueWindowStep},
+		{"false_positive_bits", &s.FalsePositiveBits},
+		{"max_unique_windows", &s.MaxUniqueWindows},
+	}
+	for _, f := range fields {
+		str := form.Get(f.name)
+		if len(str) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || n < 1 {
+			return s, fmt.Errorf("%s must be a positive integer", f.name)
+		}
+		*f.v = n
+	}
+	flags := []struct {
+		name string
+		v    *bool
+	}{
+		{"unique_check_reversed", &s.UniqueCheckReversed},
+		{"reject_excess_windows", &s.RejectExcessWindows},
+		{"hash_identities", &s.HashIdentities},
+		{"keep_identity_lookup", &s.KeepIdentityLookup},
+	}
+	for _, f := range flags {
+		str := form.Get(f.name)
+		if len(str) == 0 {
+			continue
+		}
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return s, fmt.Errorf("%s must be true or false", f.name)
+		}
+		*f.v = b
+	}
+	if s.FalsePositiveBits < minFalsePositiveBits || s.FalsePositiveBits > maxFalsePositiveBits {
+		return s, fmt.Errorf("false_positive_bits must be from %d to %d", minFalsePositiveBits, maxFalsePositiveBits)
+	}
+	return s, nil
+}
+
+// GET returns the settings as JSON; POST rate_limit=...&... changes
+// them. Only admins can call this (see app.yaml).
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	s := getSettings(ctx)
+	if r.Method == "POST" {
+		r.ParseForm()
+		var err error
+		s, err = s.update(r.Form)
+		if err != nil {
+			sendError(w, r, http.StatusBadRequest, "invalid_setting", err.Error())
+			return
+		}
+		if err := saveSettings(ctx, s); err != nil {
+			sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+			return
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,61 @@
+package randomsanity
+
+import (
+	"appengine"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSettingsUpdate(t *testing.T) {
+	var tests = []struct {
+		form  string
+		want  Settings
+		valid bool
+	}{
+		{"", defaultSettings, true},
+		{"rate_limit=120", Settings{120, 600, 200, 60, 100, 1, 1, false, 64, 49, false, false, false}, true},
+		{"registered_rate_limit=1000&max_entries_per_key=50", Settings{60, 1000, 200, 60, 50, 1, 1, false, 64, 49, false, false, false}, true},
+		{"tag_rate_limit=50", Settings{60, 600, 50, 60, 100, 1, 1, false, 64, 49, false, false, false}, true},
+		{"stream_rate_limit=10", Settings{60, 600, 200, 10, 100, 1, 1, false, 64, 49, false, false, false}, true},
+		{"unique_write_sampling=10", Settings{60, 600, 200, 60, 100, 10, 1, false, 64, 49, false, false, false}, true},
+		{"unique_window_step=16", Settings{60, 600, 200, 60, 100, 1, 16, false, 64, 49, false, false, false}, true},
+		{"unique_check_reversed=true", Settings{60, 600, 200, 60, 100, 1, 1, true, 64, 49, false, false, false}, true},
+		{"false_positive_bits=72", Settings{60, 600, 200, 60, 100, 1, 1, false, 72, 49, false, false, false}, true},
+		{"hash_identities=true&keep_identity_lookup=true", Settings{60, 600, 200, 60, 100, 1, 1, false, 64, 49, false, true, true}, true},
+		{"false_positive_bits=40", defaultSettings, false},
+		{"false_positive_bits=128", defaultSettings, false},
+		{"unique_check_reversed=maybe", defaultSettings, false},
+		{"unknown=7", defaultSettings, true},
+		{"rate_limit=0", defaultSettings, false},
+		{"max_entries_per_key=-5", defaultSettings, false},
+		{"rate_limit=lots", defaultSettings, false},
+	}
+	for _, test := range tests {
+		form, _ := url.ParseQuery(test.form)
+		got, err := defaultSettings.update(form)
+		if (err == nil) != test.valid {
+			t.Errorf("update(%q): error %v", test.form, err)
+		}
+		if test.valid && got != test.want {
+			t.Errorf("update(%q) = %+v, want %+v", test.form, got, test.want)
+		}
+	}
+}
+
+// Settings this instance read are used until settingsRefresh passes,
+// budget included, without reading them again
+func TestCacheSettings(t *testing.T) {
+	defer cacheSettings(defaultSettings)
+	s := defaultSettings
+	s.RateLimit = 120
+	s.FalsePositiveBits = 72
+	cacheSettings(s)
+	ctx := appengine.NewContext(httptest.NewRequest("GET", "/v1/q/00", nil))
+	if got := getSettings(ctx); got != s {
+		t.Errorf("getSettings() = %+v, want %+v", got, s)
+	}
+	if fpBits() != 72 {
+		t.Errorf("fpBits() = %d, want 72", fpBits())
+	}
+}
@@ -0,0 +1,164 @@
+package randomsanity
+
+// Statistical tests for samples too big for /v1/q (up to
+// maxStreamBytes), read a chunk at a time so the whole sample is
+// never in memory.
+//
+// LooksRandom is run on overlapping windows of the sample, so patterns
+// that span a window boundary are still seen. The tests that get
+// better with more data (bit balance, byte and bit count histograms)
+// also run over the whole sample, using running counts.
+//
+// Each window is another chance for random bytes to fail a test; for a
+// maxStreamBytes sample that's about 2^8 chances, so the false
+// positive rate is under 1-in-2^50 instead of 1-in-2^60.
+
+import (
+	"appengine"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// Bytes LooksRandom sees at once, and how many of them are the end of
+// the previous window
+const (
+	streamWindow  = maxInputBytes
+	streamOverlap = 64
+)
+
+// Largest sample /v1/stream accepts
+const maxStreamBytes = 1 << 20
+
+// A Stream is an io.Writer that runs the statistical tests on
+// everything written to it. The result doesn't depend on how the
+// bytes were split up between calls to Write.
+type Stream struct {
+	n      int64
+	counts [256]int64
+	window []byte
+	reason string // First window that failed
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	for _, v := range p {
+		s.counts[v]++
+	}
+	s.n += int64(len(p))
+	s.window = append(s.window, p...)
+	for len(s.window) > streamWindow {
+		if ok, reason := LooksRandom(s.window[:streamWindow]); !ok && len(s.reason) == 0 {
+			s.reason = reason
+		}
+		s.window = append(s.window[:0], s.window[streamWindow-streamOverlap:]...)
+	}
+	return len(p), nil
+}
+
+// Len returns the number of bytes written
+func (s *Stream) Len() int64 {
+	return s.n
+}
+
+// LooksRandom returns the same as LooksRandom would for everything
+// written; for more than streamWindow bytes, it runs it on each window
+// and then checks the whole sample's counts.
+func (s *Stream) LooksRandom() (bool, string) {
+	// The last window (or, for a short sample, all of it)
+	if ok, reason := LooksRandom(s.window); !ok && len(s.reason) == 0 {
+		s.reason = reason
+	}
+	if len(s.reason) > 0 {
+		return false, s.reason
+	}
+	if s.n <= streamWindow {
+		return true, ""
+	}
+
+	// Bits set, out of 8*n
+	ones := int64(0)
+	var weights [9]int64
+	for v, c := range s.counts {
+		ones += c * int64(onesCount(byte(v)))
+		weights[onesCount(byte(v))] += c
+	}
+	bits := -float64(fpBits())
+	if deviationLog2(8*s.n, ones, 0.5) <= bits {
+		return false, "Biased bits"
+	}
+	// Any of the 256 values could be too common or too rare: 8 more bits
+	for _, c := range s.counts {
+		if deviationLog2(s.n, c, 1.0/256)+8 <= bits {
+			return false, "Uneven byte values"
+		}
+	}
+	// ... or any of the 9 bit counts: 4 more bits
+	p := [9]float64{1, 8, 28, 56, 70, 56, 28, 8, 1}
+	for w, c := range weights {
+		if deviationLog2(s.n, c, p[w]/256)+4 <= bits {
+			return false, "Uneven bit counts"
+		}
+	}
+	return true, ""
+}
+
+// Returns an upper bound on log2 of the chance that n independent
+// trials, each succeeding with probability p, have a number of
+// successes at least as far from n*p as k is (Bernstein's inequality,
+// both tails).
+func deviationLog2(n int64, k int64, p float64) float64 {
+	t := math.Abs(float64(k) - float64(n)*p)
+	variance := float64(n) * p * (1 - p)
+	return 1 - t*t/(2*(variance+t/3))/math.Ln2
+}
+
+// POST a sample of up to maxStreamBytes as application/octet-stream;
+// the response is like /v1/q's, but nothing is checked for uniqueness.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "stream method must be POST")
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/octet-stream" {
+		recordRejection(r, "unsupported_media_type")
+		sendError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Content-Type must be application/octet-stream")
+		return
+	}
+	ctx := appengine.NewContext(r)
+	settings := getSettings(ctx)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("stream", clientIP(r, trustedProxies)), uint64(settings.StreamRateLimit), time.Hour)
+	if err != nil || limited {
+		return
+	}
+	var s Stream
+	if _, err := io.Copy(&s, io.LimitReader(r.Body, maxStreamBytes+1)); err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_request", "Error reading request")
+		return
+	}
+	if s.Len() > maxStreamBytes {
+		recordRejection(r, "too_large")
+		sendError(w, r, http.StatusRequestEntityTooLarge, "too_large", "Sample too large")
+		return
+	}
+	if s.Len() < 16 {
+		recordRejection(r, "too_short")
+		sendError(w, r, http.StatusBadRequest, "too_short", "Must provide 16 or more bytes")
+		return
+	}
+	nsCtx, err := namespaceContext(ctx, r)
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_namespace", "Invalid namespace")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if ok, reason := s.LooksRandom(); !ok {
+		RecordUsage(nsCtx, "Stream_Fail_"+reason, 1)
+		sendResult(w, resultNotRandom)
+		return
+	}
+	RecordUsage(nsCtx, "Stream_Success", 1)
+	sendResult(w, resultRandom)
+}
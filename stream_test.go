@@ -0,0 +1,118 @@
+package randomsanity
+
+import (
+	"bytes"
+	"crypto/rand"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Write b to a Stream in pieces of chunk bytes
+func streamVerdict(b []byte, chunk int) (bool, string) {
+	var s Stream
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		s.Write(b[:n])
+		b = b[n:]
+	}
+	return s.LooksRandom()
+}
+
+func TestStream(t *testing.T) {
+	random := make([]byte, 5*streamWindow+123)
+	rand.Read(random)
+
+	// A run of zeros across the first window boundary
+	zeros := append([]byte(nil), random...)
+	for i := 0; i < 16; i++ {
+		zeros[streamWindow-8+i] = 0
+	}
+
+	// Bits that are set 51% of the time; too subtle to see
+	// in one window
+	r := mathrand.New(mathrand.NewSource(1))
+	biased := make([]byte, 1<<19)
+	for i := range biased {
+		for bit := uint(0); bit < 8; bit++ {
+			if r.Float64() < 0.51 {
+				biased[i] |= 1 << bit
+			}
+		}
+	}
+
+	var tests = []struct {
+		name   string
+		b      []byte
+		reason string // "" for random
+	}{
+		{"short random", random[:100], ""},
+		{"one window", random[:streamWindow], ""},
+		{"short zeros", zeros[streamWindow-8 : streamWindow+24], "Repeated bytes"},
+		{"random", random, ""},
+		{"zeros", zeros, "Repeated bytes"},
+		{"biased", biased, "Biased bits"},
+	}
+	for _, test := range tests {
+		for _, chunk := range []int{1, 13, 1000, streamWindow, len(test.b)} {
+			ok, reason := streamVerdict(test.b, chunk)
+			if ok != (test.reason == "") || reason != test.reason {
+				t.Errorf("%s in %d-byte chunks: %v, %q, want %q", test.name, chunk, ok, reason, test.reason)
+			}
+		}
+		// No different from LooksRandom for what fits in one window
+		if len(test.b) <= streamWindow {
+			ok, reason := streamVerdict(test.b, len(test.b))
+			if wantOK, wantReason := LooksRandom(test.b); ok != wantOK || reason != wantReason {
+				t.Errorf("%s: Stream %v, %q; LooksRandom %v, %q", test.name, ok, reason, wantOK, wantReason)
+			}
+		}
+	}
+	// The biased bits are all in a window by themselves:
+	if ok, _ := LooksRandom(biased[:streamWindow]); !ok {
+		t.Errorf("LooksRandom(biased window) = false")
+	}
+}
+
+func TestDeviationLog2(t *testing.T) {
+	if got := deviationLog2(1000, 500, 0.5); got != 1 {
+		t.Errorf("deviationLog2(no deviation) = %v", got)
+	}
+	// 1000 fair coin flips, 700 or more heads is about 1 in 2^119;
+	// Bernstein's bound for both tails is 1 - 40000/(2*(250+200/3))/ln 2,
+	// about -90.1
+	if got := deviationLog2(1000, 700, 0.5); got > -90 || got < -91 {
+		t.Errorf("deviationLog2(1000, 700, 0.5) = %v", got)
+	}
+	if deviationLog2(1000, 300, 0.5) != deviationLog2(1000, 700, 0.5) {
+		t.Errorf("deviationLog2 not symmetric")
+	}
+}
+
+// Content-Type parameters don't matter, only the media type
+func TestStreamHandlerContentType(t *testing.T) {
+	b := make([]byte, 64)
+	rand.Read(b)
+	for _, test := range []struct {
+		contentType string
+		status      int
+	}{
+		{"application/octet-stream", http.StatusOK},
+		{"application/octet-stream; charset=binary", http.StatusOK},
+		{"Application/Octet-Stream", http.StatusOK},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	} {
+		r := httptest.NewRequest("POST", "/v1/stream", bytes.NewReader(b))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		streamHandler(w, r)
+		if w.Code != test.status {
+			t.Errorf("streamHandler(Content-Type %q) status %d, want %d: %s", test.contentType, w.Code, test.status, w.Body)
+		}
+	}
+}
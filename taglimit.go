@@ -0,0 +1,136 @@
+package randomsanity
+
+// A registered user running several services under one id, each with
+// its own tag, can keep one noisy service from using up everybody's
+// submissions: each tag has its own hourly quota
+// (Settings.TagRateLimit, or an override stored with the
+// registration), as well as counting toward the user's.
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An override of Settings.TagRateLimit for one of a user's tags
+type TagRateLimit struct {
+	Tag   string
+	Limit int64 // Submissions per hour
+}
+
+// A rate limit: at most max submissions per hour counted against key
+type limitBucket struct {
+	key string
+	max uint64
+}
+
+// Returns the buckets a /v1/q submission counts against, in the order
+// they should be checked: the tag's first, so a tag that is over its
+// quota doesn't use up any of the user's. Registered users also count
+// against their own (whatever their IP address) and their IP
+// address's, both Settings.RegisteredRateLimit.
+func submissionLimits(ip string, uID string, tag string, s Settings, overrides []TagRateLimit) []limitBucket {
+	if len(uID) == 0 {
+		return []limitBucket{{IPKey("q", ip), uint64(s.RateLimit)}}
+	}
+	var result []limitBucket
+	if len(tag) > 0 {
+		max := s.TagRateLimit
+		for _, o := range overrides {
+			if o.Tag == tag {
+				max = o.Limit
+			}
+		}
+		result = append(result, limitBucket{"qtag:" + uID + ":" + tag, uint64(max)})
+	}
+	return append(result, limitBucket{"quser:" + uID, uint64(s.RegisteredRateLimit)},
+		limitBucket{IPKey("q", ip), uint64(s.RegisteredRateLimit)})
+}
+
+// Returns overrides with tag's set to limit (or removed, if limit is 0)
+func setTagLimit(overrides []TagRateLimit, tag string, limit int64) []TagRateLimit {
+	result := []TagRateLimit{}
+	for _, o := range overrides {
+		if o.Tag != tag {
+			result = append(result, o)
+		}
+	}
+	if limit > 0 {
+		result = append(result, TagRateLimit{tag, limit})
+	}
+	return result
+}
+
+// Most tags a user can override the limit for
+const maxTagRateLimits = 32
+
+// POST /v1/taglimit/<id>?tag=<tag>&limit=<n> sets the hourly quota for
+// one of user <id>'s tags; limit=0 goes back to the default. A tag's
+// submissions still count toward the user's own limit, so a higher
+// quota can't get a user more submissions in total.
+func tagLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		sendError(w, r, http.StatusBadRequest, "method_not_allowed", "taglimit method must be POST")
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || len(parts[3]) == 0 {
+		sendError(w, r, http.StatusBadRequest, "missing_id", "Missing userID")
+		return
+	}
+	if len(parts) > 4 {
+		sendError(w, r, http.StatusBadRequest, "path_too_long", "URL path too long")
+		return
+	}
+	tag := r.FormValue("tag")
+	if len(tag) == 0 || len(tag) > 64 {
+		sendError(w, r, http.StatusBadRequest, "invalid_tag", "tag must be 1 to 64 characters")
+		return
+	}
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil || limit < 0 {
+		sendError(w, r, http.StatusBadRequest, "invalid_limit", "limit must be a non-negative integer")
+		return
+	}
+	ctx := appengine.NewContext(r)
+	limited, err := RateLimitResponse(ctx, w, r, IPKey("taglimit", clientIP(r, trustedProxies)), 10, time.Hour)
+	if err != nil || limited {
+		return
+	}
+	dbKey, err := userID(ctx, parts[3])
+	if err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	if dbKey == nil {
+		sendError(w, r, http.StatusNotFound, "not_found", "User ID not found")
+		return
+	}
+
+	ctx = defaultNamespace(ctx) // Registrations are shared by all namespaces
+	var n NotifyViaEmail
+	if err := datastore.Get(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	n.TagRateLimits = setTagLimit(n.TagRateLimits, tag, limit)
+	if len(n.TagRateLimits) > maxTagRateLimits {
+		sendError(w, r, http.StatusBadRequest, "too_many_tags",
+			fmt.Sprintf("Limits can be set for at most %d tags", maxTagRateLimits))
+		return
+	}
+	if _, err := datastore.Put(ctx, dbKey, &n); err != nil {
+		sendError(w, r, http.StatusInternalServerError, "datastore_error", "Datastore error")
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	if limit == 0 {
+		fmt.Fprintf(w, "tag %s: default limit\n", tag)
+		return
+	}
+	fmt.Fprintf(w, "tag %s: %d per hour\n", tag, limit)
+}
@@ -0,0 +1,78 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+// Counts submissions against buckets like RateLimit does (without
+// memcache); returns true if the submission was allowed
+type buckets map[string]uint64
+
+func (b buckets) submit(limits []limitBucket) bool {
+	for _, l := range limits {
+		if b[l.key] >= l.max {
+			return false
+		}
+		b[l.key]++
+	}
+	return true
+}
+
+func TestSubmissionLimits(t *testing.T) {
+	s := defaultSettings
+	s.TagRateLimit = 3
+	s.RegisteredRateLimit = 5
+	b := buckets{}
+	ip := "192.0.2.1"
+
+	// Each tag has its own bucket
+	for i := 0; i < 3; i++ {
+		if !b.submit(submissionLimits(ip, "alice", "prod", s, nil)) {
+			t.Fatalf("prod submission %d limited", i)
+		}
+	}
+	if b.submit(submissionLimits(ip, "alice", "prod", s, nil)) {
+		t.Error("prod not limited after 3")
+	}
+	if !b.submit(submissionLimits(ip, "alice", "staging", s, nil)) {
+		t.Error("staging limited by prod's submissions")
+	}
+	// ... but the user's limit caps them all (prod's rejected
+	// submission didn't count)
+	if !b.submit(submissionLimits(ip, "alice", "staging", s, nil)) {
+		t.Error("staging limited before the user's 5")
+	}
+	if b.submit(submissionLimits(ip, "alice", "staging", s, nil)) {
+		t.Error("user not limited after 5")
+	}
+	if b.submit(submissionLimits("198.51.100.7", "alice", "", s, nil)) {
+		t.Error("user not limited from another address")
+	}
+	// Somebody else's tags, and anonymous submissions, are separate
+	if !b.submit(submissionLimits("198.51.100.7", "bob", "prod", s, nil)) {
+		t.Error("bob limited by alice")
+	}
+	if !b.submit(submissionLimits("198.51.100.7", "", "", s, nil)) {
+		t.Error("anonymous limited by bob")
+	}
+}
+
+func TestTagLimitOverride(t *testing.T) {
+	s := defaultSettings
+	overrides := setTagLimit(nil, "batch", 1)
+	overrides = setTagLimit(overrides, "prod", 50)
+	limits := submissionLimits("192.0.2.1", "alice", "batch", s, overrides)
+	if len(limits) != 3 || limits[0].max != 1 || limits[1].max != uint64(s.RegisteredRateLimit) {
+		t.Errorf("submissionLimits(batch) = %+v", limits)
+	}
+	if l := submissionLimits("192.0.2.1", "alice", "other", s, overrides); l[0].max != uint64(s.TagRateLimit) {
+		t.Errorf("submissionLimits(other) = %+v", l)
+	}
+	overrides = setTagLimit(overrides, "batch", 0)
+	if len(overrides) != 1 || overrides[0] != (TagRateLimit{"prod", 50}) {
+		t.Errorf("setTagLimit(batch, 0) = %+v", overrides)
+	}
+	if l := submissionLimits("192.0.2.1", "", "batch", s, overrides); len(l) != 1 || l[0].max != uint64(s.RateLimit) {
+		t.Errorf("submissionLimits(anonymous) = %+v", l)
+	}
+}
@@ -0,0 +1,37 @@
+package randomsanity
+
+// What LooksRandom checks, so integrators can see which tests their
+// submissions get and how many bytes to send for all of them to run.
+
+import (
+	"net/http"
+)
+
+type TestInfo struct {
+	Name      string
+	Severity  string // "fail" or "warn" (see Warnings)
+	MinLength int    // Bytes needed for the test to run
+}
+
+type TestList struct {
+	Tests                   []TestInfo
+	MinBytesForFullCoverage int
+}
+
+func testList() TestList {
+	list := TestList{Tests: []TestInfo{}, MinBytesForFullCoverage: MinBytesForFullCoverage()}
+	for _, d := range detectors {
+		severity := "fail"
+		if d.severity == warn {
+			severity = "warn"
+		}
+		list.Tests = append(list.Tests, TestInfo{d.reason, severity, d.minimum()})
+	}
+	return list
+}
+
+// GET returns a TestList as JSON (at the current false-positive
+// budget)
+func testListHandler(w http.ResponseWriter, r *http.Request) {
+	sendCachedJSON(w, r, testList())
+}
@@ -0,0 +1,27 @@
+package randomsanity
+
+import (
+	"testing"
+)
+
+func TestTestList(t *testing.T) {
+	list := testList()
+	if len(list.Tests) != len(detectors) {
+		t.Fatalf("%d tests listed, want %d", len(list.Tests), len(detectors))
+	}
+	longest := 0
+	for i, test := range list.Tests {
+		if test.Name != detectors[i].reason || test.MinLength != detectors[i].minLength {
+			t.Errorf("test %d = %+v", i, test)
+		}
+		if test.MinLength > longest {
+			longest = test.MinLength
+		}
+	}
+	if list.MinBytesForFullCoverage != longest {
+		t.Errorf("MinBytesForFullCoverage = %d, want %d", list.MinBytesForFullCoverage, longest)
+	}
+	if list.Tests[0].Severity != "fail" {
+		t.Errorf("first test severity = %q", list.Tests[0].Severity)
+	}
+}
@@ -8,30 +8,160 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	mathrand "math/rand" // don't need cryptographically secure randomness here
 	"net/http"
+	"sync"
 	"time"
 )
 
-func looksUnique(ctx appengine.Context, w http.ResponseWriter, b []byte, uID string, tag string) (bool, error) {
+// For operators who must not keep anything derived from clients'
+// bytes, the uniqueness database can be made read-only (only values
+// already stored, e.g. by /v1/seed, are found) or turned off entirely,
+// leaving just the statistical tests. Responses say which in an
+// X-Uniqueness header.
+const (
+	uniqueReadWrite = iota
+	uniqueReadOnly
+	uniqueDisabled
+)
+
+const uniquenessMode = uniqueReadWrite
+
+var errTooManyWindows = errors.New("too many uniqueness windows")
+
+// Returns whether b looks unique. If the datastore lookup fails, the
+// error is returned for the caller to fall back on the statistical
+// verdict (see uniqueVerdict); for errTooManyWindows, the error
+// response has already been sent.
+func looksUnique(ctx appengine.Context, w http.ResponseWriter, r *http.Request, b []byte, uID string, tag string, rid string, settings Settings) (bool, error) {
+	switch uniquenessMode {
+	case uniqueDisabled:
+		w.Header().Set("X-Uniqueness", "disabled")
+		return true, nil
+	case uniqueReadOnly:
+		w.Header().Set("X-Uniqueness", "read-only")
+	}
+
+	// Don't wait on a datastore that's been failing (see breaker.go)
+	if !datastoreBreaker.allow(time.Now()) {
+		w.Header().Set("X-Uniqueness", "unavailable")
+		return true, nil
+	}
+
+	// Too many windows to look up them all (see uniqueOffsets)?
+	if offsets, over := uniqueOffsets(len(b), settings); over {
+		if settings.RejectExcessWindows {
+			sendError(w, r, http.StatusRequestEntityTooLarge, "too_many_windows",
+				fmt.Sprintf("At most %d windows can be checked for uniqueness", settings.MaxUniqueWindows))
+			return false, errTooManyWindows
+		}
+		w.Header().Add("X-Warning", fmt.Sprintf("Only %d of the windows were checked for uniqueness", len(offsets)))
+	}
+
+	// ... or pile on to one that's busy (see semaphore.go)
+	if !uniqueCheckSlots.acquire(uniqueCheckWait) {
+		w.Header().Set("X-Uniqueness", "busy")
+		return true, nil
+	}
+	defer uniqueCheckSlots.release()
+
 	// Test every 16-byte (128-bit) sequence in the input against our database
 
 	// if we get a match, complain!
-	match, i, err := unique(ctx, b[:], uID, tag)
+	match, err := unique(ctx, b[:], uID, tag, settings)
+	datastoreBreaker.record(err, time.Now())
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return true, err
 	}
 	if match != nil {
-		notify(ctx, uID, tag, b[i:i+16], "Non Unique")
-		if len(match.UserID) > 0 && match.UserID != uID {
-			notify(ctx, match.UserID, match.Tag, b[i:i+16], "Non Unique")
+		reason, warnings := matchReport(match)
+		for _, warning := range warnings {
+			w.Header().Add("X-Warning", warning)
+		}
+		if match.Common {
+			RecordUsage(ctx, "CommonSeed", 1)
+		}
+		if match.Reversed {
+			RecordUsage(ctx, "ReversedMatch", 1)
+		}
+		f := failure{UserID: uID, Tag: tag, RequestID: rid, Bytes: match.Window, Reason: reason}
+		each, escalate := fleetMatch(ctx, r, match, uID, tag)
+		if escalate {
+			RecordUsage(ctx, "FleetCollision", 1)
+			f.Sources, f.RequestID = fleetThreshold, ""
+			notify(ctx, f)
+			if len(match.Entry.UserID) > 0 && !match.SameUser {
+				notify(ctx, failure{UserID: match.Entry.UserID, Tag: match.Entry.Tag, Bytes: f.Bytes, Reason: f.Reason, Sources: f.Sources})
+			}
+			return false, nil
+		}
+		if !each {
+			RecordUsage(ctx, "FleetSuppressed", 1)
+			return false, nil
+		}
+		if match.SameUser {
+			// Two of the user's own deployments (e.g. "prod" and "staging")
+			f.MatchTag = match.Entry.Tag
+			notify(ctx, f)
+		} else {
+			notify(ctx, f)
+			if len(match.Entry.UserID) > 0 {
+				// Their tag, not ours; and the request ID means nothing to them
+				notify(ctx, failure{UserID: match.Entry.UserID, Tag: match.Entry.Tag, Bytes: f.Bytes, Reason: f.Reason})
+			}
 		}
 		return false, nil
 	}
 	return true, nil
 }
 
+// The result for a submission that passed the statistical tests, given
+// what looksUnique returned. If the lookup failed (timed out, say),
+// the statistical verdict stands and X-Uniqueness says the uniqueness
+// check was indeterminate, instead of the client getting nothing
+// useful back.
+func uniqueVerdict(w http.ResponseWriter, unique bool, err error) string {
+	switch {
+	case err != nil:
+		w.Header().Set("X-Uniqueness", "indeterminate")
+		return resultRandom
+	case unique:
+		return resultRandom
+	}
+	return resultNotUnique
+}
+
+// Counts match toward a fleet-wide collision (see fleet.go); if that
+// can't be done, the match is notified on its own
+func fleetMatch(ctx appengine.Context, r *http.Request, match *uniqueMatch, uID string, tag string) (bool, bool) {
+	secret, err := secretKey(ctx)
+	if err != nil {
+		return true, false
+	}
+	each, escalate, err := countFleetMatch(ctx, match.Hash, fleetSource(secret, uID, tag, clientIP(r, trustedProxies)))
+	if err != nil {
+		return true, false
+	}
+	return each, escalate
+}
+
+// Returns the failure reason, and any X-Warning headers, for match
+func matchReport(match *uniqueMatch) (string, []string) {
+	reason := "Non Unique"
+	var warnings []string
+	if match.Common {
+		warnings = append(warnings, "Already submitted in full by another user; likely a common low-entropy seed")
+	}
+	if match.Reversed {
+		warnings = append(warnings, "Byte-reversed copy of an earlier submission")
+		reason = "Non Unique (byte-reversed)"
+	}
+	return reason, warnings
+}
+
 //
 // Entities in the 'RBH' datastore;
 // storing 16 "random we hope" bytes.
@@ -49,6 +179,11 @@ func looksUnique(ctx appengine.Context, w http.ResponseWriter, b []byte, uID str
 // so comparing random 128-bit chunks we get
 // a chance of collision of any pair of about 1-in-2^64
 //
+// The client's bytes are never stored, not even encrypted: keys and
+// Trailing are pieces of a one-way hash of each 16-byte window,
+// keyed with a server secret (see hash16). Same window, same hash,
+// so matching still works.
+//
 
 const prefixBytes = 4 // Use 4 for production, 1 for development/testing collisions
 
@@ -67,33 +202,76 @@ type SecretBytes struct {
 	CreationTime int64
 }
 
+// The secret never changes once it is created, so it is kept in memory
+// after the first datastore lookup. If the secret is ever rotated this
+// cache must be cleared.
+// Each namespace has its own secret.
+type secretStore struct {
+	sync.Mutex
+	secrets map[string][]byte
+}
+
+var secretCache secretStore
+
+// Returns ns's secret, calling load the first time. The lock is held
+// across load on purpose: cold requests wait for one load instead of
+// each querying (and, for a new namespace, each creating a secret).
+// That happens once per namespace per instance.
+func (c *secretStore) get(ns string, load func() ([]byte, error)) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if secret, ok := c.secrets[ns]; ok {
+		return secret, nil
+	}
+	result, err := load()
+	if err != nil {
+		return result, err
+	}
+	if c.secrets == nil {
+		c.secrets = make(map[string][]byte)
+	}
+	c.secrets[ns] = result
+	return result, nil
+}
+
 func secretKey(ctx appengine.Context) ([]byte, error) {
-	var result []byte
+	return secretCache.get(namespace(ctx), func() ([]byte, error) { return loadSecretKey(ctx) })
+}
 
-	// Create random secret if it doesn't already exist:
+func loadSecretKey(ctx appengine.Context) ([]byte, error) {
 	var secrets []SecretBytes
 
 	q := datastore.NewQuery("SecretBytes")
 	if _, err := q.GetAll(ctx, &secrets); err != nil {
+		return nil, err
+	}
+	result, store, err := pickSecret(secrets, uniquenessMode)
+	if err != nil || !store {
 		return result, err
 	}
-	if len(secrets) == 0 {
-		var b [16]byte
-		if _, err := rand.Read(b[:]); err != nil {
-			return result, err
-		}
-		result = b[:]
-		secret := SecretBytes{result, time.Now().Unix()}
-		k := datastore.NewIncompleteKey(ctx, "SecretBytes", nil)
-		if _, err := datastore.Put(ctx, k, &secret); err != nil {
-			return result, err
-		}
-	} else {
-		result = secrets[0].Secret
+	secret := SecretBytes{result, time.Now().Unix()}
+	k := datastore.NewIncompleteKey(ctx, "SecretBytes", nil)
+	if _, err := datastore.Put(ctx, k, &secret); err != nil {
+		return result, err
 	}
 	return result, nil
 }
 
+// Returns the first of secrets, or a new random secret if there are
+// none; store is true if the new secret should be saved. A read-only
+// database never saves one: with no secret, nothing was ever stored,
+// so a throwaway secret matches exactly what any secret would.
+func pickSecret(secrets []SecretBytes, mode int) (secret []byte, store bool, err error) {
+	if len(secrets) > 0 {
+		return secrets[0].Secret, false, nil
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, false, err
+	}
+	return b[:], mode == uniqueReadWrite, nil
+}
+
 func i64(b []byte) int64 {
 	var result int64
 	for i := uint(0); i < uint(len(b)) && i < 8; i++ {
@@ -133,81 +311,320 @@ func hash16(secret []byte, data []byte) []byte {
 	return h[0:16]
 }
 
-func unique(ctx appengine.Context, b []byte, uID string, tag string) (*RngUniqueBytesEntry, int, error) {
-	n := len(b) - 15 // Number of queries
-	keys := make([]*datastore.Key, n)
-	vals := make([]*RngUniqueBytes, n)
+// A stored entry that a submission matched
+type uniqueMatch struct {
+	Entry    RngUniqueBytesEntry
+	Window   []byte // The 16 submitted bytes that matched (reversed, if Reversed)
+	Common   bool   // commonSeed thinks the submission came from a seed several clients share
+	Reversed bool   // The window matched when byte-reversed
+	SameUser bool   // Entry is the submitter's own (e.g. another of their tags)
+	Hash     []byte // Window's hash, as stored
+}
+
+// Returns the first stored entry that matches a window of b (or, if
+// none does and Settings.UniqueCheckReversed is on, of b reversed), or
+// nil if b looks unique.
+func unique(ctx appengine.Context, b []byte, uID string, tag string, settings Settings) (*uniqueMatch, error) {
+	offsets, _ := uniqueOffsets(len(b), settings)
+	n := len(offsets) // Windows of b; its reverse's are after them
 
 	// Input is first hashed with a secret, to prevent an attacker
 	// from intentionally causing database entry collisions.
 	secret, err := secretKey(ctx)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	chunks, windows := lookupWindows(secret, b, offsets, settings.UniqueCheckReversed)
+	vals, err := lookupBuckets(ctx, chunks)
+	if err != nil {
+		return nil, err
 	}
+	// What's stored for the submitter's ID (see identity.go)
+	sUID := storedIdentity(secret, uID, settings.HashIdentities)
 
-	chunks := make([][]byte, n)
-	for i := 0; i < n; i++ {
-		chunks[i] = hash16(secret, b[i:i+16])
+	found, first := matchWindows(chunks, vals)
+	if first >= 0 {
+		sameIdentity(found, sUID, storedIdentity(secret, uID, !settings.HashIdentities))
+		// ... full match!
+		m := newMatch(found, first, n, windows[first], sUID)
+		m.Hash = chunks[first]
+		// Rewriting keeps this entry from getting evicted
+		// and overwriting the userid prevents the
+		// user from getting too many notifications
+		write(ctx, chunks[first][:], time.Now().Unix(), "", m.Entry.Tag, settings.MaxEntriesPerKey)
+		m.Entry.UserID, m.Entry.Tag = revealIdentity(ctx, m.Entry.UserID, settings), revealIdentity(ctx, m.Entry.Tag, settings)
+		return m, nil
+	}
+	// Known-bad values are only seeded in the default namespace
+	if len(namespace(ctx)) > 0 {
+		if m, err := seededMatch(ctx, b, offsets, settings.UniqueCheckReversed); err != nil || m != nil {
+			return m, err
+		}
+	}
+	// If no matches, store the first and last 16 bytes. Any future
+	// overlapping sequences will trigger a match (if the overlap lines
+	// up with the window step; see windowOffsets).
+	if !sampledWrite(settings.UniqueWriteSampling) {
+		return nil, nil
+	}
+	sUID, sTag := storeIdentity(ctx, secret, uID, settings), storeIdentity(ctx, secret, tag, settings)
+	err = write(ctx, chunks[0][:], time.Now().Unix(), sUID, sTag, settings.MaxEntriesPerKey)
+	if err == nil && n > 1 {
+		err = write(ctx, chunks[n-1][:], time.Now().Unix(), sUID, sTag, settings.MaxEntriesPerKey)
+	}
+	return nil, err
+}
 
-		keys[i] = datastore.NewKey(ctx, "RBH", "", 1+i64(chunks[i][0:prefixBytes]), nil)
+// Returns the buckets (see bucketID) of the window hashes in chunks
+func lookupBuckets(ctx appengine.Context, chunks [][]byte) ([]*RngUniqueBytes, error) {
+	keys := make([]*datastore.Key, len(chunks))
+	vals := make([]*RngUniqueBytes, len(chunks))
+	for i := range chunks {
+		keys[i] = datastore.NewKey(ctx, "RBH", "", bucketID(chunks[i]), nil)
 		vals[i] = new(RngUniqueBytes)
 	}
-	err = datastore.GetMulti(ctx, keys, vals)
-	err = dealWithMultiError(err)
+	err := datastore.GetMulti(ctx, keys, vals)
+	return vals, dealWithMultiError(err)
+}
 
+// Returns the match for the first window of b (at offsets, and
+// reversed if reversed is true) that is a seeded known-bad value (see
+// seed.go), or nil. Seeds are stored in the default namespace, under
+// its secret, so clients using ns=... or an org are checked against
+// them here; nothing else stored there is matched.
+func seededMatch(ctx appengine.Context, b []byte, offsets []int, reversed bool) (*uniqueMatch, error) {
+	ctx = defaultNamespace(ctx)
+	secret, err := secretKey(ctx)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	chunks, windows := lookupWindows(secret, b, offsets, reversed)
+	vals, err := lookupBuckets(ctx, chunks)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		v.Hits = seededHits(v.Hits)
 	}
+	found, first := matchWindows(chunks, vals)
+	if first < 0 {
+		return nil, nil
+	}
+	m := newMatch(found, first, len(offsets), windows[first], "")
+	m.Hash = chunks[first]
+	return m, nil
+}
+
+// The entries of hits that seedHandler stored
+func seededHits(hits []RngUniqueBytesEntry) []RngUniqueBytesEntry {
+	var result []RngUniqueBytesEntry
+	for _, h := range hits {
+		if h.Tag == seedTag && len(h.UserID) == 0 {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+// The match for found[first] (of n windows, then any reversed ones),
+// where sUID is the submitter's stored user ID. Entry's UserID and
+// Tag are as stored.
+func newMatch(found []*RngUniqueBytesEntry, first int, n int, window []byte, sUID string) *uniqueMatch {
+	e := *found[first]
+	return &uniqueMatch{Entry: e, Window: window, Common: commonSeed(found[:n], sUID),
+		Reversed: first >= n, SameUser: len(sUID) > 0 && e.UserID == sUID}
+}
+
+// The RBH key for a window's hash
+func bucketID(chunk []byte) int64 {
+	return 1 + i64(chunk[0:prefixBytes])
+}
+
+// Returns the hashes (one datastore key each) and bytes of the
+// windows unique() looks up: b's at offsets, then if reversed is true
+// b reversed's
+func lookupWindows(secret []byte, b []byte, offsets []int, reversed bool) ([][]byte, [][]byte) {
+	chunks := windowChunks(secret, b, offsets)
+	windows := windowBytes(b, offsets)
+	if reversed {
+		r := reverseBytes(b)
+		chunks = append(chunks, windowChunks(secret, r, offsets)...)
+		windows = append(windows, windowBytes(r, offsets)...)
+	}
+	return chunks, windows
+}
+
+// Returns the hashes of b's windows at offsets
+func windowChunks(secret []byte, b []byte, offsets []int) [][]byte {
+	chunks := make([][]byte, len(offsets))
+	for i, o := range offsets {
+		chunks[i] = hash16(secret, b[o:o+16])
+	}
+	return chunks
+}
+
+func windowBytes(b []byte, offsets []int) [][]byte {
+	windows := make([][]byte, len(offsets))
+	for i, o := range offsets {
+		windows[i] = b[o : o+16]
+	}
+	return windows
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, v := range b {
+		r[len(b)-1-i] = v
+	}
+	return r
+}
+
+// Returns, for each window hash in chunks, the entry in its bucket
+// (vals[i]) that matches it, if any; and the index of the first match,
+// or -1.
+func matchWindows(chunks [][]byte, vals []*RngUniqueBytes) ([]*RngUniqueBytesEntry, int) {
+	found := make([]*RngUniqueBytesEntry, len(chunks))
+	first := -1
 	for i, hit := range vals {
-		for _, h := range hit.Hits {
-			if bytes.Equal(h.Trailing, chunks[i][prefixBytes:]) {
-				// Rewriting keeps this entry from getting evicted
-				// and overwriting the userid prevents the
-				// user from getting too many notifications
-				write(ctx, chunks[i][:], time.Now().Unix(), "", h.Tag)
-				return &h, i, nil // ... full match!
+		for j := range hit.Hits {
+			if bytes.Equal(hit.Hits[j].Trailing, chunks[i][prefixBytes:]) {
+				found[i] = &hit.Hits[j]
+				if first < 0 {
+					first = i
+				}
+				break
 			}
 		}
 	}
-	// If no matches, store the first and last 16 bytes. Any future
-	// overlapping sequences will trigger a match.
-	err = write(ctx, chunks[0][:], time.Now().Unix(), uID, tag)
-	if err == nil && n > 1 {
-		err = write(ctx, chunks[n-1][:], time.Now().Unix(), uID, tag)
+	return found, first
+}
+
+// Inputs this long or shorter always have every window looked up
+const smallUniqueInput = 32
+
+// Returns the offsets of the 16-byte windows of an n-byte input to
+// look up: every step bytes (every byte for small inputs), and always
+// the last window, which is one of the two unique() stores.
+func windowOffsets(n int, step int) []int {
+	if n < 16 {
+		return nil
 	}
-	if err != nil {
-		return nil, 0, err
+	if step < 1 || n <= smallUniqueInput {
+		step = 1
+	}
+	var result []int
+	for i := 0; i <= n-16; i += step {
+		result = append(result, i)
+	}
+	if result[len(result)-1] != n-16 {
+		result = append(result, n-16)
 	}
-	return nil, 0, nil
+	return result
 }
 
-func write(ctx appengine.Context, b []byte, t int64, uID string, tag string) error {
-	const maxEntriesPerKey = 100
+// Returns the offsets of an n-byte input's windows to look up with
+// settings s, and true if there were more than s.MaxUniqueWindows.
+// Then only the first ones are, plus the last (which unique() may
+// store).
+func uniqueOffsets(n int, s Settings) ([]int, bool) {
+	offsets := windowOffsets(n, int(s.UniqueWindowStep))
+	max := int(s.MaxUniqueWindows)
+	if len(offsets) <= max || max < 1 {
+		return offsets, false
+	}
+	return append(offsets[:max-1:max-1], offsets[len(offsets)-1]), true
+}
 
-	key := datastore.NewKey(ctx, "RBH", "", 1+i64(b[0:prefixBytes]), nil)
+// Returns true about 1 in factor times (see Settings.UniqueWriteSampling)
+func sampledWrite(factor int64) bool {
+	return factor <= 1 || mathrand.Int63n(factor) == 0
+}
 
-	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
-		hit := new(RngUniqueBytes)
-		err := datastore.Get(ctx, key, hit)
-		if err != nil && err != datastore.ErrNoSuchEntity {
-			return err
+// Returns true if the windows of a submission that unique() stores
+// (the first and last; found[i] is the stored entry matching window i,
+// if any) were all already stored, and those entries and the submitter
+// (uID) are two or more different users. Hashes of low-entropy inputs
+// (usernames, small counters) look random, but different clients
+// using them end up with the same bytes.
+// Only registered users count; a match blanks the UserID of the one
+// window it rewrites, so the other windows' entries are what's left.
+func commonSeed(found []*RngUniqueBytesEntry, uID string) bool {
+	if len(found) == 0 || found[0] == nil || found[len(found)-1] == nil {
+		return false
+	}
+	users := make(map[string]bool)
+	if len(uID) > 0 {
+		users[uID] = true
+	}
+	for _, e := range found {
+		if e != nil && len(e.UserID) > 0 {
+			users[e.UserID] = true
 		}
-		// Find and remove old entry (if any):
-		hits := hit.Hits[:0]
-		for _, h := range hit.Hits {
-			if !bytes.Equal(h.Trailing, b[prefixBytes:]) {
-				hits = append(hits, h)
+	}
+	return len(users) >= 2
+}
+
+// Stores hash b in its bucket, keeping at most maxEntriesPerKey
+// entries (Settings.MaxEntriesPerKey; callers read it once per request)
+func write(ctx appengine.Context, b []byte, t int64, uID string, tag string, maxEntriesPerKey int64) error {
+	if uniquenessMode != uniqueReadWrite {
+		return nil
+	}
+
+	key := datastore.NewKey(ctx, "RBH", "", bucketID(b), nil)
+
+	err := retryContention(writeAttempts, writeBackoff, time.Sleep, func() error {
+		return datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+			hit := new(RngUniqueBytes)
+			err := datastore.Get(ctx, key, hit)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
 			}
-		}
-		// Append new:
-		e := RngUniqueBytesEntry{Trailing: b[prefixBytes:], Time: t, UserID: uID, Tag: tag}
-		hit.Hits = append(hits, e)
-		// Throw out half the old if bucket overflows:
-		if len(hit.Hits) > maxEntriesPerKey {
-			hit.Hits = hit.Hits[len(hit.Hits)/2:]
-		}
-		_, err = datastore.Put(ctx, key, hit)
-		return err
-	}, nil)
+			// Find and remove old entry (if any):
+			hits := hit.Hits[:0]
+			for _, h := range hit.Hits {
+				if !bytes.Equal(h.Trailing, b[prefixBytes:]) {
+					hits = append(hits, h)
+				}
+			}
+			// Append new:
+			e := RngUniqueBytesEntry{Trailing: b[prefixBytes:], Time: t, UserID: uID, Tag: tag}
+			hit.Hits = append(hits, e)
+			// Throw out half the old if bucket overflows:
+			if int64(len(hit.Hits)) > maxEntriesPerKey {
+				hit.Hits = hit.Hits[len(hit.Hits)/2:]
+			}
+			_, err = datastore.Put(ctx, key, hit)
+			return err
+		}, nil)
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		// Still too busy. Losing one entry is better than failing
+		// the submission; count how often it happens.
+		RecordUsage(ctx, "WriteContention", 1)
+		return nil
+	}
+	return err
+}
+
+// Buckets that many submissions hit at once make write()'s
+// transactions fail with ErrConcurrentTransaction, even after the
+// datastore package's own retries; try a few more times, waiting
+// longer each time so the writers spread out.
+const (
+	writeAttempts = 4
+	writeBackoff  = 50 * time.Millisecond
+)
+
+// Calls f until it returns anything but ErrConcurrentTransaction, at
+// most attempts times, sleeping backoff (then twice as long, and so
+// on, plus up to half again at random) in between.
+func retryContention(attempts int, backoff time.Duration, sleep func(time.Duration), f func() error) error {
+	err := f()
+	for i := 1; i < attempts && err == datastore.ErrConcurrentTransaction; i++ {
+		sleep(backoff + time.Duration(mathrand.Int63n(int64(backoff)/2+1)))
+		backoff *= 2
+		err = f()
+	}
 	return err
 }
@@ -0,0 +1,406 @@
+package randomsanity
+
+import (
+	"appengine/datastore"
+	"errors"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommonSeed(t *testing.T) {
+	alice := &RngUniqueBytesEntry{UserID: "alice"}
+	bob := &RngUniqueBytesEntry{UserID: "bob"}
+	anon := &RngUniqueBytesEntry{}
+	var tests = []struct {
+		found []*RngUniqueBytesEntry
+		uID   string
+		want  bool
+	}{
+		{[]*RngUniqueBytesEntry{alice, bob}, "", true},
+		{[]*RngUniqueBytesEntry{alice, anon, bob, alice}, "", true},
+		{[]*RngUniqueBytesEntry{alice, nil, nil, bob}, "", true}, // Middle windows are never stored
+		{[]*RngUniqueBytesEntry{alice, bob, nil}, "", false},     // Last window is new
+		{[]*RngUniqueBytesEntry{alice, alice, alice}, "", false},
+		{[]*RngUniqueBytesEntry{alice, alice}, "bob", true},
+		{[]*RngUniqueBytesEntry{alice, alice}, "alice", false},
+		{[]*RngUniqueBytesEntry{anon, alice}, "bob", true}, // First window rewritten by an earlier match
+		{[]*RngUniqueBytesEntry{alice, anon}, "", false},
+		{[]*RngUniqueBytesEntry{anon, anon}, "bob", false},
+		{[]*RngUniqueBytesEntry{alice}, "bob", true},
+		{[]*RngUniqueBytesEntry{alice}, "", false},
+		{nil, "bob", false},
+	}
+	for i, test := range tests {
+		if got := commonSeed(test.found, test.uID); got != test.want {
+			t.Errorf("test %d: commonSeed(%q) = %v", i, test.uID, got)
+		}
+	}
+}
+
+// Alice's submission stored its first and last windows, as unique()
+// does; then others submit the same bytes
+func TestCommonSeedStored(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	b := make([]byte, 64)
+	for i := range b {
+		b[i] = byte(i*37 + 11)
+	}
+	offsets := windowOffsets(len(b), 1)
+	n := len(offsets)
+	chunks := windowChunks(secret, b, offsets)
+	vals := make([]*RngUniqueBytes, n)
+	for i := range vals {
+		vals[i] = new(RngUniqueBytes)
+	}
+	for _, i := range []int{0, n - 1} {
+		vals[i].Hits = []RngUniqueBytesEntry{{Trailing: chunks[i][prefixBytes:], UserID: "alice"}}
+	}
+
+	found, first := matchWindows(chunks, vals)
+	if first != 0 {
+		t.Fatalf("matchWindows: first match %d, want 0", first)
+	}
+	for _, test := range []struct {
+		uID  string
+		want bool
+	}{{"bob", true}, {"alice", false}, {"", false}} {
+		if got := commonSeed(found, test.uID); got != test.want {
+			t.Errorf("commonSeed(%q) = %v", test.uID, got)
+		}
+	}
+
+	// The same first 16 bytes, but the rest is new
+	other := append([]byte{}, b...)
+	other[63]++
+	found, _ = matchWindows(windowChunks(secret, other, offsets), vals)
+	if commonSeed(found, "bob") {
+		t.Error("commonSeed(last window new) = true")
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	var c secretStore
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	load := func(ns string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads[ns]++
+			return []byte("secret for " + ns), nil
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, ns := range []string{"", "product"} {
+			wg.Add(1)
+			go func(ns string) {
+				defer wg.Done()
+				secret, err := c.get(ns, load(ns))
+				if err != nil || string(secret) != "secret for "+ns {
+					t.Errorf("get(%q) = %q, %v", ns, secret, err)
+				}
+			}(ns)
+		}
+	}
+	wg.Wait()
+	if loads[""] != 1 || loads["product"] != 1 {
+		t.Errorf("loads = %v, want one per namespace", loads)
+	}
+
+	// Failed loads aren't cached
+	var d secretStore
+	if _, err := d.get("", func() ([]byte, error) { return nil, errors.New("datastore down") }); err == nil {
+		t.Error("get() didn't return the load error")
+	}
+	if secret, err := d.get("", load("retry")); err != nil || string(secret) != "secret for retry" {
+		t.Errorf("get() after a failed load = %q, %v", secret, err)
+	}
+}
+
+func TestPickSecret(t *testing.T) {
+	stored := []SecretBytes{{Secret: []byte("0123456789abcdef")}}
+	for _, mode := range []int{uniqueReadWrite, uniqueReadOnly, uniqueDisabled} {
+		if secret, store, err := pickSecret(stored, mode); err != nil || store || string(secret) != "0123456789abcdef" {
+			t.Errorf("mode %d, stored secret: %q, %v, %v", mode, secret, store, err)
+		}
+		secret, store, err := pickSecret(nil, mode)
+		if err != nil || len(secret) != 16 {
+			t.Errorf("mode %d, no secret: %q, %v", mode, secret, err)
+		}
+		// Only a read-write database is ever written to
+		if store != (mode == uniqueReadWrite) {
+			t.Errorf("mode %d, no secret: store = %v", mode, store)
+		}
+	}
+}
+
+func TestSampledWrite(t *testing.T) {
+	const trials = 10000
+	for _, factor := range []int64{0, 1, 4, 100} {
+		n := 0
+		for i := 0; i < trials; i++ {
+			if sampledWrite(factor) {
+				n++
+			}
+		}
+		want := trials
+		if factor > 1 {
+			want = trials / int(factor)
+		}
+		// Several standard deviations of slack; never fails in practice
+		if n < want-want/4-20 || n > want+want/4+20 {
+			t.Errorf("sampledWrite(%d) true %d of %d times, want about %d", factor, n, trials, want)
+		}
+	}
+}
+
+func TestUniqueOffsets(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	s := defaultSettings
+	var tests = []struct {
+		n        int
+		max      int64
+		step     int64
+		reversed bool
+		want     int // Datastore keys looked up
+		over     bool
+	}{
+		{64, 49, 1, false, 49, false}, // The default: all of 64 bytes
+		{64, 49, 1, true, 98, false},
+		{65, 49, 1, false, 49, true},
+		{256, 49, 1, false, 49, true},
+		{256, 49, 1, true, 98, true},
+		{256, 10, 1, false, 10, true},
+		{256, 10, 16, false, 10, true},
+		{256, 20, 16, false, 16, false},
+		{256, 1, 1, false, 1, true},
+		{16, 1, 1, false, 1, false},
+	}
+	for _, test := range tests {
+		s.MaxUniqueWindows, s.UniqueWindowStep, s.UniqueCheckReversed = test.max, test.step, test.reversed
+		offsets, over := uniqueOffsets(test.n, s)
+		keys, _ := lookupWindows(secret, b[:test.n], offsets, s.UniqueCheckReversed)
+		if len(keys) != test.want || over != test.over {
+			t.Errorf("%+v: %d keys, %v", test, len(keys), over)
+		}
+		// The last window, which unique() may store, is always looked up
+		if offsets[len(offsets)-1] != test.n-16 {
+			t.Errorf("%+v: offsets %v", test, offsets)
+		}
+	}
+}
+
+func TestWindowOffsets(t *testing.T) {
+	var tests = []struct {
+		n    int
+		step int
+		want int // Number of windows
+	}{
+		{15, 1, 0},
+		{16, 1, 1},
+		{17, 1, 2},
+		{64, 1, 49},
+		{32, 16, 17}, // Small inputs: every window
+		{64, 16, 4},
+		{64, 0, 49},
+		{65, 16, 5}, // ... plus the last
+		{64, 8, 7},
+		{64, 48, 2},
+		{64, 100, 2},
+	}
+	for _, test := range tests {
+		got := windowOffsets(test.n, test.step)
+		if len(got) != test.want {
+			t.Errorf("windowOffsets(%d, %d) = %v, want %d windows", test.n, test.step, got, test.want)
+			continue
+		}
+		if len(got) == 0 {
+			continue
+		}
+		// The two windows unique() stores are always looked up
+		if got[0] != 0 || got[len(got)-1] != test.n-16 {
+			t.Errorf("windowOffsets(%d, %d) = %v", test.n, test.step, got)
+		}
+	}
+	// A window stored from an earlier submission is still found if it
+	// lines up with the step
+	offsets := windowOffsets(64, 16)
+	for _, want := range []int{0, 16, 32, 48} {
+		found := false
+		for _, o := range offsets {
+			found = found || o == want
+		}
+		if !found {
+			t.Errorf("windowOffsets(64, 16) = %v, missing %d", offsets, want)
+		}
+	}
+}
+
+// Alice's 64 bytes were stored (their first and last windows, as
+// unique() stores them); then somebody submits them byte-reversed
+func TestReversedMatch(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	stored := make([]byte, 64)
+	for i := range stored {
+		stored[i] = byte(i*37 + 11)
+	}
+	offsets := windowOffsets(len(stored), 1)
+	n := len(offsets)
+	storedChunks := windowChunks(secret, stored, offsets)
+	bucket := func(chunk []byte) *RngUniqueBytes {
+		for _, i := range []int{0, n - 1} {
+			if bucketID(chunk) == bucketID(storedChunks[i]) {
+				return &RngUniqueBytes{Hits: []RngUniqueBytesEntry{{Trailing: storedChunks[i][prefixBytes:], UserID: "alice"}}}
+			}
+		}
+		return new(RngUniqueBytes)
+	}
+
+	// What unique() looks up: b's windows, then its reverse's
+	submitted := reverseBytes(stored)
+	chunks := append(windowChunks(secret, submitted, offsets), windowChunks(secret, reverseBytes(submitted), offsets)...)
+	vals := make([]*RngUniqueBytes, len(chunks))
+	for i := range chunks {
+		vals[i] = bucket(chunks[i])
+	}
+	found, first := matchWindows(chunks, vals)
+	if first != n {
+		t.Fatalf("first match %d, want %d (the first reversed window)", first, n)
+	}
+	if found[first].UserID != "alice" {
+		t.Errorf("matched %q, want alice", found[first].UserID)
+	}
+	for i := 0; i < n; i++ {
+		if found[i] != nil {
+			t.Errorf("forward window %d matched", i)
+		}
+	}
+
+	reason, warnings := matchReport(&uniqueMatch{Entry: *found[first], Reversed: first >= n})
+	if reason != "Non Unique (byte-reversed)" {
+		t.Errorf("reason = %q", reason)
+	}
+	if len(warnings) != 1 || warnings[0] != "Byte-reversed copy of an earlier submission" {
+		t.Errorf("warnings = %q", warnings)
+	}
+	if reason, warnings := matchReport(&uniqueMatch{}); reason != "Non Unique" || len(warnings) != 0 {
+		t.Errorf("forward match: %q, %q", reason, warnings)
+	}
+}
+
+func TestReverseBytes(t *testing.T) {
+	if got := string(reverseBytes([]byte("abc"))); got != "cba" {
+		t.Errorf("reverseBytes(abc) = %q", got)
+	}
+	if got := reverseBytes(nil); len(got) != 0 {
+		t.Errorf("reverseBytes(nil) = %v", got)
+	}
+}
+
+func TestRetryContention(t *testing.T) {
+	var slept []time.Duration
+	sleep := func(d time.Duration) { slept = append(slept, d) }
+	failing := func(n int, err error) func() error {
+		return func() error {
+			if n > 0 {
+				n--
+				return err
+			}
+			return nil
+		}
+	}
+
+	if err := retryContention(4, 10*time.Millisecond, sleep, failing(2, datastore.ErrConcurrentTransaction)); err != nil {
+		t.Errorf("retryContention(fails twice) = %v", err)
+	}
+	// Backing off: 10ms then 20ms, plus up to half again
+	if len(slept) != 2 || slept[0] < 10*time.Millisecond || slept[0] > 15*time.Millisecond ||
+		slept[1] < 20*time.Millisecond || slept[1] > 30*time.Millisecond {
+		t.Errorf("retryContention slept %v", slept)
+	}
+
+	slept = nil
+	if err := retryContention(4, time.Millisecond, sleep, failing(10, datastore.ErrConcurrentTransaction)); err != datastore.ErrConcurrentTransaction || len(slept) != 3 {
+		t.Errorf("retryContention(always fails) = %v after %d sleeps", err, len(slept))
+	}
+
+	// Other errors aren't retried
+	slept = nil
+	other := errors.New("datastore down")
+	if err := retryContention(4, time.Millisecond, sleep, failing(1, other)); err != other || len(slept) != 0 {
+		t.Errorf("retryContention(other error) = %v after %d sleeps", err, len(slept))
+	}
+}
+
+// Many writers to one bucket, each transaction failing if another
+// committed since it read, all get their entry in
+func TestRetryContentionConcurrent(t *testing.T) {
+	var bucket struct {
+		sync.Mutex
+		version int
+		entries []int
+	}
+	transaction := func(entry int) error {
+		bucket.Lock()
+		version := bucket.version
+		bucket.Unlock()
+		runtime.Gosched() // Let other writers in
+
+		bucket.Lock()
+		defer bucket.Unlock()
+		if bucket.version != version {
+			return datastore.ErrConcurrentTransaction
+		}
+		bucket.version++
+		bucket.entries = append(bucket.entries, entry)
+		return nil
+	}
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- retryContention(100, 100*time.Microsecond, time.Sleep, func() error { return transaction(i) })
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("write failed: %v", err)
+		}
+	}
+	if len(bucket.entries) != writers {
+		t.Errorf("%d entries written, want %d", len(bucket.entries), writers)
+	}
+}
+
+// A uniqueness lookup that times out still gets the statistical verdict
+func TestUniqueVerdict(t *testing.T) {
+	var tests = []struct {
+		unique     bool
+		err        error
+		want       string
+		uniqueness string // X-Uniqueness
+	}{
+		{true, nil, resultRandom, ""},
+		{false, nil, resultNotUnique, ""},
+		{true, errors.New("API error 5 (datastore_v3: TIMEOUT): The datastore operation timed out"), resultRandom, "indeterminate"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if got := uniqueVerdict(w, test.unique, test.err); got != test.want || w.Header().Get("X-Uniqueness") != test.uniqueness {
+			t.Errorf("uniqueVerdict(%v, %v) = %s, X-Uniqueness %q", test.unique, test.err, got, w.Header().Get("X-Uniqueness"))
+		}
+	}
+}
@@ -3,10 +3,11 @@ package randomsanity
 import (
 	"appengine"
 	"appengine/datastore"
-	"encoding/json"
 	"log"
 	"math/rand" // don't need cryptographically secure randomness here
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Keep track of usage stats
@@ -20,25 +21,107 @@ type UsageRecord struct {
 	N int64 `datastore:",noindex"`
 }
 
+// Counts are buffered in memory and written to the datastore by the
+// RecordUsage that makes usageFlushThreshold of them, or the first
+// one after usageFlushInterval has passed, so the hot UsageRecord
+// entities see far fewer transactions. An instance that goes idle
+// would keep its counts until it shut down, so flushUsageHandler
+// writes them too: cron calls it every minute (on whichever instance
+// serves the request), and App Engine calls /_ah/stop before shutting
+// down a manual or basic scaling instance. Counts on an idle instance
+// that cron doesn't reach can still be lost when it is shut down;
+// usage stats are best-effort anyway.
+const usageFlushInterval = time.Minute
+const usageFlushThreshold = 100
+
+type usageKey struct {
+	ns string // See namespace.go
+	k  string
+}
+
+type usageBuffer struct {
+	sync.Mutex
+	counts    map[usageKey]int64
+	n         int // Increments since last flush
+	lastFlush time.Time
+}
+
+// Adds n to k's count; returns true if it is time to flush
+func (u *usageBuffer) add(k usageKey, n int64, now time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.counts == nil {
+		u.counts = make(map[usageKey]int64)
+	}
+	u.counts[k] += n
+	u.n++
+	return u.n >= usageFlushThreshold || now.Sub(u.lastFlush) >= usageFlushInterval
+}
+
+// Returns the buffered counts, and empties the buffer
+func (u *usageBuffer) take(now time.Time) map[usageKey]int64 {
+	u.Lock()
+	defer u.Unlock()
+	counts := u.counts
+	u.counts = nil
+	u.n = 0
+	u.lastFlush = now
+	return counts
+}
+
+var pendingUsage usageBuffer
+
 func RecordUsage(ctx appengine.Context, k string, n int64) {
 	if rand.Intn(SAMPLING_FACTOR) != 0 {
 		return
 	}
+	if pendingUsage.add(usageKey{namespace(ctx), k}, n*SAMPLING_FACTOR, time.Now()) {
+		flushUsage(ctx)
+	}
+}
+
+// Write buffered counts to the datastore, every key's transaction at
+// once, so the request that flushes waits for the slowest one instead
+// of all of them
+func flushUsage(ctx appengine.Context) {
+	var wg sync.WaitGroup
+	for k, n := range pendingUsage.take(time.Now()) {
+		wg.Add(1)
+		go func(k usageKey, n int64) {
+			defer wg.Done()
+			nsCtx, err := appengine.Namespace(ctx, k.ns)
+			if err == nil {
+				err = writeUsage(nsCtx, k.k, n)
+			}
+			if err != nil {
+				log.Printf("Datastore error: %s", err.Error())
+				// Try again next flush:
+				pendingUsage.add(k, n, time.Now())
+			}
+		}(k, n)
+	}
+	wg.Wait()
+}
+
+// Writes this instance's buffered counts. Only admins, cron and App
+// Engine itself can call this (see app.yaml and cron.yaml).
+func flushUsageHandler(w http.ResponseWriter, r *http.Request) {
+	flushUsage(appengine.NewContext(r))
+}
+
+func writeUsage(ctx appengine.Context, k string, n int64) error {
 	key := datastore.NewKey(ctx, "UsageRecord", k, 0, nil)
 
-	err := datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
+	return datastore.RunInTransaction(ctx, func(ctx appengine.Context) error {
 		r := UsageRecord{K: k, N: 0}
 		err := datastore.Get(ctx, key, &r)
 		if err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
-		r.N += n * SAMPLING_FACTOR
+		r.N += n
 		_, err = datastore.Put(ctx, key, &r)
 		return err
 	}, nil)
-	if err != nil {
-		log.Printf("Datastore error: %s", err.Error())
-	}
 }
 
 func GetUsage(ctx appengine.Context) []UsageRecord {
@@ -53,13 +136,15 @@ func GetUsage(ctx appengine.Context) []UsageRecord {
 }
 
 func usageHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	ctx := appengine.NewContext(r)
+	ctx, err := namespaceContext(appengine.NewContext(r), r)
+	if err != nil {
+		sendError(w, r, http.StatusBadRequest, "invalid_namespace", "Invalid namespace")
+		return
+	}
 	usage := GetUsage(ctx)
 	m := make(map[string]int64)
 	for _, rr := range usage {
 		m[rr.K] = rr.N
 	}
-	enc := json.NewEncoder(w)
-	enc.Encode(m)
+	sendCachedJSON(w, r, m)
 }
@@ -0,0 +1,66 @@
+package randomsanity
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsageBuffer(t *testing.T) {
+	var u usageBuffer
+	start := time.Now()
+	u.take(start)
+
+	k := usageKey{"", "Success"}
+	if u.add(k, 1, start) {
+		t.Errorf("add() wants flush right after take()")
+	}
+	if !u.add(k, 1, start.Add(usageFlushInterval)) {
+		t.Errorf("add() doesn't want flush after usageFlushInterval")
+	}
+	if counts := u.take(start); len(counts) != 1 || counts[k] != 2 {
+		t.Errorf("take() = %v", counts)
+	}
+	if counts := u.take(start); len(counts) != 0 {
+		t.Errorf("second take() = %v", counts)
+	}
+
+	// Concurrent increments aren't lost, and namespaces are kept apart:
+	var wg sync.WaitGroup
+	flushes := 0
+	var mu sync.Mutex
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if u.add(usageKey{[]string{"", "a"}[i%2], "Success"}, 1, start) {
+				mu.Lock()
+				flushes++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	counts := u.take(start)
+	if counts[usageKey{"", "Success"}] != 500 || counts[usageKey{"a", "Success"}] != 500 {
+		t.Errorf("take() = %v", counts)
+	}
+	if flushes < 1000/usageFlushThreshold {
+		t.Errorf("%d flushes wanted for 1000 increments", flushes)
+	}
+}
+
+// The flush handler writes every buffered count, whatever RecordUsage
+// would have done
+func TestFlushUsageHandler(t *testing.T) {
+	pendingUsage.take(time.Now())
+	for _, k := range []string{"Success", "Repeat", "Fail_Counting"} {
+		pendingUsage.add(usageKey{"", k}, 1, time.Now())
+	}
+	r := httptest.NewRequest("GET", "/_ah/stop", nil)
+	flushUsageHandler(httptest.NewRecorder(), r)
+	if counts := pendingUsage.take(time.Now()); len(counts) != 0 {
+		t.Errorf("counts left after flush: %v", counts)
+	}
+}
@@ -0,0 +1,61 @@
+package randomsanity
+
+// Well-known test and weak keys that end up in production code because
+// somebody copied an example. They're fixed values, so an exact match
+// can't be a false positive no matter how short the key is.
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+var knownKeys = []struct {
+	hexbytes string
+	name     string
+}{
+	// FIPS-197 appendix C
+	{"000102030405060708090a0b0c0d0e0f", "FIPS-197 AES-128 example key"},
+	{"000102030405060708090a0b0c0d0e0f1011121314151617", "FIPS-197 AES-192 example key"},
+	{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "FIPS-197 AES-256 example key"},
+	// FIPS-197 appendix A, NIST SP 800-38A appendix F
+	{"2b7e151628aed2a6abf7158809cf4f3c", "NIST AES-128 test key"},
+	{"8e73b0f7da0e6452c810f32b809079e562f8ead2522c6b7b", "NIST AES-192 test key"},
+	{"603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4", "NIST AES-256 test key"},
+	// NIST SP 800-67 Triple-DES example, and a common two-key variant
+	{"0123456789abcdef23456789abcdef01456789abcdef0123", "NIST Triple-DES example key"},
+	{"0123456789abcdeffedcba9876543210", "Two-key Triple-DES test key"},
+	// Strings from tutorials
+	{"30313233343536373839616263646566", `ASCII "0123456789abcdef"`},
+	{"30313233343536373839414243444546", `ASCII "0123456789ABCDEF"`},
+	{"59454c4c4f57205355424d4152494e45", `ASCII "YELLOW SUBMARINE"`},
+	{"5369787465656e2062797465206b6579", `ASCII "Sixteen byte key"`},
+}
+
+// The four DES weak keys (encrypting twice decrypts), which make
+// Triple-DES no stronger than DES if used for all of its keys
+var desWeakKeys = []string{"0101010101010101", "fefefefefefefefe", "e0e0e0e0f1f1f1f1", "1f1f1f1f0e0e0e0e"}
+
+// Returns the name of the well-known key b is, or "" if it isn't one
+func KnownKey(b []byte) string {
+	if len(b) != 16 && len(b) != 24 && len(b) != 32 {
+		return ""
+	}
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return "All-zero key"
+	}
+	h := hex.EncodeToString(b)
+	for _, k := range knownKeys {
+		if h == k.hexbytes {
+			return k.name
+		}
+	}
+	// Triple-DES (16 or 24 bytes) with the same weak key throughout
+	if len(b) < 32 && bytes.Equal(b, bytes.Repeat(b[:8], len(b)/8)) {
+		for _, w := range desWeakKeys {
+			if h[:16] == w {
+				return "DES weak key " + w
+			}
+		}
+	}
+	return ""
+}
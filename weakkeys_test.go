@@ -0,0 +1,41 @@
+package randomsanity
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestKnownKey(t *testing.T) {
+	var tests = []struct {
+		hexbytes string
+		want     string
+	}{
+		{"00000000000000000000000000000000", "All-zero key"},
+		{"000000000000000000000000000000000000000000000000", "All-zero key"},
+		{"2b7e151628aed2a6abf7158809cf4f3c", "NIST AES-128 test key"},
+		{"603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4", "NIST AES-256 test key"},
+		{"000102030405060708090a0b0c0d0e0f", "FIPS-197 AES-128 example key"},
+		{"59454c4c4f57205355424d4152494e45", `ASCII "YELLOW SUBMARINE"`},
+		{"e0e0e0e0f1f1f1f1e0e0e0e0f1f1f1f1", "DES weak key e0e0e0e0f1f1f1f1"},
+		{"1f1f1f1f0e0e0e0e1f1f1f1f0e0e0e0e1f1f1f1f0e0e0e0e", "DES weak key 1f1f1f1f0e0e0e0e"},
+		// Not exact matches:
+		{"e0e0e0e0f1f1f1f1e0e0e0e0f1f1f1f0", ""},
+		{"2b7e151628aed2a6abf7158809cf4f3c00", ""},
+		{"0000000000000000000000000000000000", ""},
+		{"e0e0e0e0f1f1f1f1e0e0e0e0f1f1f1f1e0e0e0e0f1f1f1f1e0e0e0e0f1f1f1f1", ""},
+		// Random key
+		{"13edbd95b51624cbaa36ed7bc011b152", ""},
+	}
+	for _, test := range tests {
+		b, err := hex.DecodeString(test.hexbytes)
+		if err != nil {
+			panic(err)
+		}
+		if got := KnownKey(b); got != test.want {
+			t.Errorf("KnownKey(%s) = %q, want %q", test.hexbytes, got, test.want)
+		}
+	}
+	if ok, reason := LooksRandom([]byte("YELLOW SUBMARINE")); ok || reason != `Known test key: ASCII "YELLOW SUBMARINE"` {
+		t.Errorf("LooksRandom(YELLOW SUBMARINE) = %v, %q", ok, reason)
+	}
+}